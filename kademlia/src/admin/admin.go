@@ -0,0 +1,703 @@
+// Package admin implements the admin HTTP server: JSON endpoints mirroring
+// the commands of the stdin REPL, so nodes can be driven by other programs.
+// Every request has to carry the admin token as "Authorization: Bearer
+// <token>". Files and keys travel in the JSON bodies, base64 encoded: the
+// API never touches the filesystem of the node.
+package admin
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+import (
+	"kademlia"
+)
+
+type adminServer struct {
+	k     *kademlia.Kademlia
+	token string
+}
+
+// Request body of every endpoint, each one uses the fields it needs.
+type adminRequest struct {
+	Target     string `json:"target"`
+	NodeID     string `json:"node_id"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	VdoID      string `json:"vdo_id"`
+	Data       string `json:"data"`
+	NumberKeys int    `json:"number_keys"`
+	Threshold  int    `json:"threshold"`
+	Timeout    int64  `json:"timeout"`
+	FindValue  bool   `json:"find_value"`
+	TTL        int64  `json:"ttl"`
+	ReadQuorum int    `json:"read_quorum"`
+	VDO        string `json:"vdo"`
+	Binary     bool   `json:"binary"`
+	// base64 in JSON
+	File      []byte `json:"file"`
+	RecordKey []byte `json:"record_key"`
+}
+
+type adminContact struct {
+	NodeID   string   `json:"node_id"`
+	Host     string   `json:"host"`
+	Port     uint16   `json:"port"`
+	AltHosts []string `json:"alt_hosts,omitempty"`
+}
+
+type adminTraceQuery struct {
+	Contact    adminContact   `json:"contact"`
+	LatencyMs  float64        `json:"latency_ms"`
+	Success    bool           `json:"success"`
+	FoundValue bool           `json:"found_value"`
+	Returned   []adminContact `json:"returned"`
+}
+
+type adminTraceRound struct {
+	Final     bool              `json:"final"`
+	Queries   []adminTraceQuery `json:"queries"`
+	Shortlist []adminContact    `json:"shortlist"`
+}
+
+type adminError struct {
+	status int
+	msg    string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+func badRequest(msg string) error {
+	return &adminError{http.StatusBadRequest, msg}
+}
+
+func notFound(msg string) error {
+	return &adminError{http.StatusNotFound, msg}
+}
+
+// The node asked for it, but a remote operation failed.
+func remoteFailure(msg string) error {
+	return &adminError{http.StatusBadGateway, msg}
+}
+
+func toAdminContact(c kademlia.Contact) adminContact {
+	ret := adminContact{NodeID: c.NodeID.AsString(), Host: c.Host.String(), Port: c.Port}
+	for _, alt := range c.AltHosts {
+		ret.AltHosts = append(ret.AltHosts, alt.String())
+	}
+	return ret
+}
+
+func toAdminContacts(cl []kademlia.Contact) []adminContact {
+	ret := []adminContact{}
+	for _, c := range cl {
+		ret = append(ret, toAdminContact(c))
+	}
+	return ret
+}
+
+func parseID(name string, str string) (kademlia.ID, error) {
+	id, err := kademlia.IDFromString(str)
+	if err != nil || str == "" {
+		return id, badRequest("Provided an invalid " + name + " (" + str + ")")
+	}
+	return id, nil
+}
+
+func (a *adminServer) contact(str string) (*kademlia.Contact, error) {
+	id, err := parseID("node ID", str)
+	if err != nil {
+		return nil, err
+	}
+	c, err := a.k.FindContact(id)
+	if err != nil {
+		return nil, notFound("Unable to find contact with node ID (" + str + ")")
+	}
+	return c, nil
+}
+
+// Our Do* functions report failures in the returned string only.
+func checkResult(res string) (string, error) {
+	if strings.HasPrefix(res, "ERR") || strings.HasPrefix(res, "Failed") {
+		return "", remoteFailure(res)
+	}
+	return res, nil
+}
+
+// Serve the admin API of k on addr, over TLS if certFile and keyFile are
+// given. Without them, the token would travel in the clear, so addr has to be
+// a loopback address.
+func ListenAndServe(addr string, k *kademlia.Kademlia, token string, certFile string, keyFile string) error {
+	if certFile != "" || keyFile != "" {
+		return http.ListenAndServeTLS(addr, certFile, keyFile, NewServer(k, token))
+	}
+	if !isLoopback(addr) {
+		return errors.New("Serving on " + addr + " requires TLS, only loopback addresses may do without")
+	}
+	return http.ListenAndServe(addr, NewServer(k, token))
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The handler serving the admin API of k.
+func NewServer(k *kademlia.Kademlia, token string) http.Handler {
+	a := &adminServer{k, token}
+	mux := http.NewServeMux()
+	a.handle(mux, "/whoami", "GET", a.whoami)
+	a.handle(mux, "/routing_table", "GET", a.routingTable)
+	a.handle(mux, "/contact", "POST", a.printContact)
+	a.handle(mux, "/ping", "POST", a.ping)
+	a.handle(mux, "/nat_check", "POST", a.natCheck)
+	a.handle(mux, "/local_find_value", "POST", a.localFindValue)
+	a.handle(mux, "/store", "POST", a.store)
+	a.handle(mux, "/find_node", "POST", a.findNode)
+	a.handle(mux, "/find_value", "POST", a.findValue)
+	a.handle(mux, "/iterative_find_node", "POST", a.iterativeFindNode)
+	a.handle(mux, "/iterative_store", "POST", a.iterativeStore)
+	a.handle(mux, "/iterative_find_value", "POST", a.iterativeFindValue)
+	a.handle(mux, "/iterative_store_content", "POST", a.iterativeStoreContent)
+	a.handle(mux, "/iterative_find_content", "POST", a.iterativeFindContent)
+	a.handle(mux, "/iterative_append", "POST", a.iterativeAppend)
+	a.handle(mux, "/iterative_find_values", "POST", a.iterativeFindValues)
+	a.handle(mux, "/iterative_put_record", "POST", a.iterativePutRecord)
+	a.handle(mux, "/put_file", "POST", a.putFile)
+	a.handle(mux, "/get_file", "POST", a.getFile)
+	a.handle(mux, "/trace", "POST", a.trace)
+	a.handle(mux, "/vanish", "POST", a.vanish)
+	a.handle(mux, "/unvanish", "POST", a.unvanish)
+	a.handle(mux, "/vanish_export", "POST", a.vanishExport)
+	a.handle(mux, "/unvanish_import", "POST", a.unvanishImport)
+	a.handle(mux, "/vdo_list", "GET", a.vdoList)
+	a.handle(mux, "/vdo_cancel", "POST", a.vdoCancel)
+	a.handle(mux, "/vdo_extend", "POST", a.vdoExtend)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (a *adminServer) handle(mux *http.ServeMux, path string, method string,
+	fn func(req adminRequest) (interface{}, error)) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid or missing admin token"})
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method must be " + method})
+			return
+		}
+		var req adminRequest
+		if method == "POST" {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON body: " + err.Error()})
+				return
+			}
+		}
+		res, err := fn(req)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if e, ok := err.(*adminError); ok {
+				status = e.status
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+}
+
+func (a *adminServer) whoami(req adminRequest) (interface{}, error) {
+	return map[string]string{"node_id": a.k.NodeID.AsString()}, nil
+}
+
+func (a *adminServer) routingTable(req adminRequest) (interface{}, error) {
+	return map[string]interface{}{
+		"contacts": toAdminContacts(a.k.Contacts()),
+		"buckets":  a.k.RoutingTableSnapshot(),
+	}, nil
+}
+
+func (a *adminServer) printContact(req adminRequest) (interface{}, error) {
+	c, err := a.contact(req.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	return toAdminContact(*c), nil
+}
+
+func (a *adminServer) ping(req adminRequest) (interface{}, error) {
+	var res string
+	if c, err := a.contact(req.Target); err == nil {
+		res = a.k.DoPing(c.Host, c.Port)
+	} else {
+		host, port, err := kademlia.ParseHostPort(req.Target)
+		if err != nil {
+			return nil, badRequest("Not a valid Node ID or host:port address")
+		}
+		res = a.k.DoPing(host, port)
+	}
+	res, err := checkResult(res)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"result": res}, nil
+}
+
+func (a *adminServer) natCheck(req adminRequest) (interface{}, error) {
+	res, err := checkResult(a.k.DoNATCheck())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"result": res}, nil
+}
+
+func (a *adminServer) localFindValue(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	_, val := a.k.LocalFindValue(key)
+	if val == nil {
+		return nil, notFound("Key(" + req.Key + ") not found")
+	}
+	return map[string]string{"key": req.Key, "value": string(val)}, nil
+}
+
+func (a *adminServer) store(req adminRequest) (interface{}, error) {
+	c, err := a.contact(req.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	res, err := checkResult(a.k.DoStore(c, key, []byte(req.Value)))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"result": res}, nil
+}
+
+func (a *adminServer) findNode(req adminRequest) (interface{}, error) {
+	c, err := a.contact(req.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	res, nodes := a.k.DoFindNode(c, key)
+	if nodes == nil {
+		return nil, remoteFailure(res)
+	}
+	return map[string]interface{}{"contacts": toAdminContacts(nodes)}, nil
+}
+
+func (a *adminServer) findValue(req adminRequest) (interface{}, error) {
+	c, err := a.contact(req.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	res, val, nodes := a.k.DoFindValue(c, key)
+	if _, err := checkResult(res); err != nil {
+		return nil, err
+	}
+	if val != nil {
+		return map[string]string{"value": string(val)}, nil
+	}
+	return map[string]interface{}{"contacts": toAdminContacts(nodes)}, nil
+}
+
+func (a *adminServer) iterativeFindNode(req adminRequest) (interface{}, error) {
+	key, err := parseID("node ID", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	_, nodes := a.k.DoIterativeFindNode(key)
+	return map[string]interface{}{"contacts": toAdminContacts(nodes)}, nil
+}
+
+func (a *adminServer) iterativeStore(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	report := a.k.IterativeStore(key, []byte(req.Value))
+	if !report.QuorumMet() {
+		return nil, remoteFailure(report.String())
+	}
+	failed := []map[string]interface{}{}
+	for _, f := range report.Failed {
+		failed = append(failed, map[string]interface{}{"contact": toAdminContact(f.Contact), "error": f.Err.Error()})
+	}
+	return map[string]interface{}{"contacts": toAdminContacts(report.Accepted), "failed": failed}, nil
+}
+
+func (a *adminServer) iterativeFindValue(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if req.ReadQuorum < 0 || req.ReadQuorum > kademlia.K {
+		return nil, badRequest("Provided an invalid read quorum")
+	}
+	var val []byte
+	if req.ReadQuorum > 0 {
+		_, val, _ = a.k.DoQuorumFindValue(key, req.ReadQuorum)
+	} else {
+		_, val, _ = a.k.DoIterativeFindValue(key)
+	}
+	if val == nil {
+		return nil, notFound("Key(" + req.Key + ") not found")
+	}
+	return map[string]string{"value": string(val)}, nil
+}
+
+func (a *adminServer) iterativeStoreContent(req adminRequest) (interface{}, error) {
+	res, key, nodes := a.k.DoIterativeStoreContent([]byte(req.Value))
+	if _, err := checkResult(res); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"key": key.AsString(), "contacts": toAdminContacts(nodes)}, nil
+}
+
+func (a *adminServer) iterativeFindContent(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	_, val, _ := a.k.DoIterativeFindContent(key)
+	if val == nil {
+		return nil, notFound("Key(" + req.Key + ") not found")
+	}
+	return map[string]string{"value": string(val)}, nil
+}
+
+func (a *adminServer) iterativeAppend(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if req.TTL < 0 {
+		return nil, badRequest("The TTL must be positive")
+	}
+	ttl := kademlia.DefaultAppendTTL
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	res, nodes := a.k.DoIterativeAppend(key, []byte(req.Value), ttl)
+	if _, err := checkResult(res); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"contacts": toAdminContacts(nodes)}, nil
+}
+
+func (a *adminServer) iterativeFindValues(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	_, vals := a.k.DoIterativeFindValues(key)
+	if vals == nil {
+		return nil, notFound("Key(" + req.Key + ") not found")
+	}
+	values := []string{}
+	for _, val := range vals {
+		values = append(values, string(val))
+	}
+	return map[string]interface{}{"values": values}, nil
+}
+
+// Sign value with the ed25519 key whose seed is record_key, a new one
+// returned in the response without it, and store it under the key derived
+// from its public key.
+func (a *adminServer) iterativePutRecord(req adminRequest) (interface{}, error) {
+	var priv ed25519.PrivateKey
+	if req.RecordKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		priv = key
+	} else if len(req.RecordKey) == ed25519.SeedSize {
+		priv = ed25519.NewKeyFromSeed(req.RecordKey)
+	} else {
+		return nil, badRequest("record_key must be a 32 byte ed25519 seed")
+	}
+	res, record, nodes := a.k.DoIterativePutRecord(priv, []byte(req.Value))
+	if record == nil {
+		return nil, remoteFailure(res)
+	}
+	ret := map[string]interface{}{
+		"key":      kademlia.RecordKey(record.PublicKey).AsString(),
+		"seq":      record.Seq,
+		"contacts": toAdminContacts(nodes),
+	}
+	if req.RecordKey == nil {
+		ret["record_key"] = priv.Seed()
+	}
+	return ret, nil
+}
+
+// Store the contents of file.
+func (a *adminServer) putFile(req adminRequest) (interface{}, error) {
+	if req.File == nil {
+		return nil, badRequest("Provided no file")
+	}
+	key, err := a.k.PutBlob(req.File)
+	if err != nil {
+		return nil, remoteFailure(err.Error())
+	}
+	return map[string]interface{}{"key": key.AsString(), "size": len(req.File)}, nil
+}
+
+// Fetch the file stored under key.
+func (a *adminServer) getFile(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := a.k.GetBlob(key)
+	if err != nil {
+		return nil, remoteFailure(err.Error())
+	}
+	return map[string]interface{}{"file": data, "size": len(data)}, nil
+}
+
+func (a *adminServer) trace(req adminRequest) (interface{}, error) {
+	key, err := parseID("key", req.Key)
+	if err != nil {
+		return nil, err
+	}
+	trace := a.k.TraceLookup(key, req.FindValue)
+	rounds := []adminTraceRound{}
+	for _, round := range trace.Rounds {
+		r := adminTraceRound{Final: round.Final, Shortlist: toAdminContacts(round.Shortlist), Queries: []adminTraceQuery{}}
+		for _, q := range round.Queries {
+			r.Queries = append(r.Queries, adminTraceQuery{
+				Contact:    toAdminContact(q.Contact),
+				LatencyMs:  q.Latency.Seconds() * 1000,
+				Success:    q.Success,
+				FoundValue: q.FoundValue,
+				Returned:   toAdminContacts(q.Returned),
+			})
+		}
+		rounds = append(rounds, r)
+	}
+	res := map[string]interface{}{
+		"key":         req.Key,
+		"duration_ms": trace.Duration.Seconds() * 1000,
+		"termination": trace.Termination,
+		"rounds":      rounds,
+		"contacts":    toAdminContacts(trace.Contacts),
+	}
+	if trace.Value != nil {
+		res["value"] = string(trace.Value)
+		res["value_from"] = trace.ValueFrom.NodeID.AsString()
+	}
+	return res, nil
+}
+
+func (a *adminServer) vanish(req adminRequest) (interface{}, error) {
+	vdoID, err := parseID("VDO ID", req.VdoID)
+	if err != nil {
+		return nil, err
+	}
+	if req.NumberKeys <= 0 || req.NumberKeys > 255 || req.Threshold <= 0 || req.Threshold > req.NumberKeys {
+		return nil, badRequest("number_keys must be in [1, 255] and threshold in [1, number_keys]")
+	}
+	timeout := req.Timeout
+	if timeout == 0 {
+		timeout = -1
+	}
+	report, err := a.k.Vanish(vdoID, []byte(req.Data), byte(req.NumberKeys), byte(req.Threshold),
+		time.Duration(timeout)*time.Hour)
+	if err != nil {
+		if report.Attempted() == 0 {
+			return nil, badRequest(err.Error())
+		}
+		return nil, remoteFailure(report.String())
+	}
+	shares := []adminShare{}
+	for _, share := range report.Shares {
+		shares = append(shares, adminShare{share.Key.AsString(), share.QuorumMet(), toAdminContacts(share.Accepted),
+			len(share.Failed)})
+	}
+	return map[string]interface{}{
+		"vdo_id":    vdoID.AsString(),
+		"vdo":       string(kademlia.ArmorVDO(report.VDO)),
+		"expires":   report.VDO.ExpiresAt(),
+		"threshold": report.VDO.Threshold,
+		"attempted": report.Attempted(),
+		"stored":    report.Stored,
+		"shares":    shares,
+	}, nil
+}
+
+type adminShare struct {
+	Location string         `json:"location"`
+	Stored   bool           `json:"stored"`
+	Nodes    []adminContact `json:"nodes"`
+	Failed   int            `json:"failed"`
+}
+
+// Unvanish the VDO given armored in vdo, or the one stored under vdo_id on
+// node_id, or on this node without node_id.
+func (a *adminServer) unvanish(req adminRequest) (interface{}, error) {
+	var vdo kademlia.VanishingDataObject
+	if req.VDO != "" {
+		parsed, err := kademlia.ParseVDO([]byte(req.VDO))
+		if err != nil {
+			return nil, badRequest("Provided an invalid VDO: " + err.Error())
+		}
+		vdo = parsed
+	} else {
+		vdoID, err := parseID("VDO ID", req.VdoID)
+		if err != nil {
+			return nil, err
+		}
+		if req.NodeID == "" {
+			local, ok := a.k.LocalVDO(vdoID)
+			if !ok {
+				return nil, notFound("No VDO stored under " + req.VdoID)
+			}
+			vdo = local
+		} else {
+			c, err := a.contact(req.NodeID)
+			if err != nil {
+				return nil, err
+			}
+			res, ok := a.k.FetchVDO(c, vdoID)
+			if !ok {
+				return nil, remoteFailure("Failed to GetVDO")
+			}
+			if res.Err != nil {
+				return nil, notFound(res.Err.Error())
+			}
+			vdo = res.VDO
+		}
+	}
+	return a.unvanishVDO(vdo)
+}
+
+func (a *adminServer) unvanishVDO(vdo kademlia.VanishingDataObject) (interface{}, error) {
+	data, err := a.k.Unvanish(vdo)
+	if err == nil {
+		return map[string]string{"result": "OK, data =>\n" + string(data)}, nil
+	}
+	// these are about the VDO, not the network failing us
+	switch {
+	case errors.Is(err, kademlia.ErrVDOExpired):
+		return nil, &adminError{http.StatusGone, err.Error()}
+	case errors.Is(err, kademlia.ErrVDODecrypt):
+		return nil, &adminError{http.StatusUnprocessableEntity, err.Error()}
+	case errors.Is(err, kademlia.ErrNotEnoughShares):
+		return nil, notFound(err.Error())
+	case errors.Is(err, kademlia.ErrVDOFormat):
+		return nil, badRequest(err.Error())
+	}
+	return nil, remoteFailure(err.Error())
+}
+
+// Return the VDO held under vdo_id armored in vdo, or binary in file.
+func (a *adminServer) vanishExport(req adminRequest) (interface{}, error) {
+	vdoID, err := parseID("VDO ID", req.VdoID)
+	if err != nil {
+		return nil, err
+	}
+	res, encoded := a.k.DoVanishExport(vdoID, !req.Binary)
+	if encoded == nil {
+		return nil, notFound(res)
+	}
+	if req.Binary {
+		return map[string]interface{}{"file": encoded}, nil
+	}
+	return map[string]string{"vdo": string(encoded)}, nil
+}
+
+// Unvanish the VDO in file, either encoding written by vanish_export.
+func (a *adminServer) unvanishImport(req adminRequest) (interface{}, error) {
+	vdo, err := kademlia.ParseVDO(req.File)
+	if err != nil {
+		return nil, badRequest("Provided an invalid VDO: " + err.Error())
+	}
+	return a.unvanishVDO(vdo)
+}
+
+type adminScheduledVDO struct {
+	VdoID     string    `json:"vdo_id"`
+	Expires   time.Time `json:"expires"`
+	NextPush  time.Time `json:"next_push"`
+	LastPush  time.Time `json:"last_push,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Failures  int       `json:"failures"`
+}
+
+func (a *adminServer) vdoList(req adminRequest) (interface{}, error) {
+	ret := []adminScheduledVDO{}
+	for _, s := range a.k.ScheduledVDOs() {
+		ret = append(ret, adminScheduledVDO{s.VdoID.AsString(), s.VDO.ExpiresAt(), s.NextPush, s.LastPush,
+			s.LastErr, s.Failures})
+	}
+	return map[string]interface{}{"vdos": ret}, nil
+}
+
+func (a *adminServer) vdoCancel(req adminRequest) (interface{}, error) {
+	vdoID, err := parseID("VDO ID", req.VdoID)
+	if err != nil {
+		return nil, err
+	}
+	res := a.k.DoVDOCancel(vdoID)
+	if strings.HasPrefix(res, "ERR") {
+		return nil, notFound(res)
+	}
+	return map[string]string{"result": res}, nil
+}
+
+// Push back the expiry of the VDO by timeout hours.
+func (a *adminServer) vdoExtend(req adminRequest) (interface{}, error) {
+	vdoID, err := parseID("VDO ID", req.VdoID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Timeout <= 0 {
+		return nil, badRequest("timeout must be a positive number of hours")
+	}
+	res, err := checkResult(a.k.DoVDOExtend(vdoID, time.Duration(req.Timeout)*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"result": res}, nil
+}
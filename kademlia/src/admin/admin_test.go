@@ -0,0 +1,236 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+import (
+	"kademlia"
+)
+
+const testToken = "secret"
+
+// well above the ports of the kademlia tests, which may run meanwhile
+var testPort = 5600
+
+func newTestNode(t *testing.T) *kademlia.Kademlia {
+	laddr := "localhost:" + strconv.Itoa(testPort)
+	testPort++
+	k, err := kademlia.NewKademliaWithLogger(laddr, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal("Failed to start a node: " + err.Error())
+	}
+	return k
+}
+
+// Send body as JSON to the admin server, returning the status and the
+// decoded response.
+func adminCall(h http.Handler, method string, path string, token string, body interface{}) (int, map[string]interface{}) {
+	var reqBody io.Reader
+	if s, ok := body.(string); ok {
+		reqBody = bytes.NewBufferString(s)
+	} else if body != nil {
+		data, _ := json.Marshal(body)
+		reqBody = bytes.NewBuffer(data)
+	}
+	req := httptest.NewRequest(method, path, reqBody)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestAdminAuth(t *testing.T) {
+	k := newTestNode(t)
+	defer k.Close()
+	h := NewServer(k, testToken)
+	if status, _ := adminCall(h, "GET", "/whoami", "", nil); status != http.StatusUnauthorized {
+		t.Error("A request without the token should be refused, got " + strconv.Itoa(status))
+	}
+	if status, _ := adminCall(h, "GET", "/whoami", "wrong", nil); status != http.StatusUnauthorized {
+		t.Error("A request with a wrong token should be refused, got " + strconv.Itoa(status))
+	}
+	status, res := adminCall(h, "GET", "/whoami", testToken, nil)
+	if status != http.StatusOK || res["node_id"] != k.NodeID.AsString() {
+		t.Error("whoami should return the node ID")
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	k1, k2 := newTestNode(t), newTestNode(t)
+	defer k1.Close()
+	h := NewServer(k1, testToken)
+	self := k2.Self()
+	target := kademlia.JoinHostPort(self.Host, self.Port)
+	if status, _ := adminCall(h, "POST", "/ping", testToken, map[string]string{"target": target}); status != http.StatusOK {
+		t.Error("Ping failed with " + strconv.Itoa(status))
+		return
+	}
+	missing := kademlia.NewRandomID().AsString()
+	// the shares of these VDOs were never stored
+	vdo := kademlia.VanishingDataObject{AccessKey: []byte("access key"), Ciphertext: []byte("ciphertext"),
+		NumberKeys: 5, Threshold: 3, Epoch: time.Now().Unix() / kademlia.EpochPeriod,
+		Expires: time.Now().Add(time.Hour).Unix()}
+	unknown := string(kademlia.ArmorVDO(vdo))
+	vdo.Expires = time.Now().Add(-time.Hour).Unix()
+	expired := string(kademlia.ArmorVDO(vdo))
+	cases := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"GET", "/ping", nil, http.StatusMethodNotAllowed},
+		{"POST", "/whoami", nil, http.StatusMethodNotAllowed},
+		{"POST", "/ping", "{not json", http.StatusBadRequest},
+		{"POST", "/local_find_value", map[string]string{"key": "zz"}, http.StatusBadRequest},
+		{"POST", "/vanish", map[string]interface{}{"vdo_id": missing, "number_keys": 3, "threshold": 4}, http.StatusBadRequest},
+		{"POST", "/local_find_value", map[string]string{"key": missing}, http.StatusNotFound},
+		{"POST", "/contact", map[string]string{"node_id": missing}, http.StatusNotFound},
+		{"POST", "/vdo_cancel", map[string]string{"vdo_id": missing}, http.StatusNotFound},
+		{"POST", "/vanish_export", map[string]string{"vdo_id": missing}, http.StatusNotFound},
+		{"POST", "/put_file", map[string]string{}, http.StatusBadRequest},
+		{"POST", "/iterative_put_record", map[string][]byte{"record_key": []byte("short")}, http.StatusBadRequest},
+		{"POST", "/unvanish_import", map[string][]byte{"file": []byte("garbage")}, http.StatusBadRequest},
+		{"POST", "/unvanish", map[string]string{"vdo": expired}, http.StatusGone},
+		{"POST", "/unvanish", map[string]string{"vdo": unknown}, http.StatusNotFound},
+		{"POST", "/unvanish", map[string]string{"vdo_id": missing, "node_id": k2.NodeID.AsString()}, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if status, res := adminCall(h, c.method, c.path, testToken, c.body); status != c.status {
+			t.Error(c.method + " " + c.path + ": expected " + strconv.Itoa(c.status) + ", got " + strconv.Itoa(status))
+		} else if res["error"] == nil {
+			t.Error(c.method + " " + c.path + ": the error should be returned")
+		}
+	}
+	// a remote node failing is a bad gateway
+	k2.Close()
+	status, _ := adminCall(h, "POST", "/store", testToken,
+		map[string]string{"node_id": k2.NodeID.AsString(), "key": missing, "value": "value"})
+	if status != http.StatusBadGateway {
+		t.Error("A store to a node that is gone should fail with 502, got " + strconv.Itoa(status))
+	}
+}
+
+func TestAdminRoundTrip(t *testing.T) {
+	k1, k2 := newTestNode(t), newTestNode(t)
+	defer k1.Close()
+	defer k2.Close()
+	h := NewServer(k1, testToken)
+	self := k2.Self()
+	adminCall(h, "POST", "/ping", testToken, map[string]string{"target": kademlia.JoinHostPort(self.Host, self.Port)})
+	time.Sleep(30 * time.Millisecond)
+
+	key := kademlia.NewRandomID().AsString()
+	if status, res := adminCall(h, "POST", "/iterative_store", testToken,
+		map[string]string{"key": key, "value": "value"}); status != http.StatusOK {
+		t.Error("iterative_store failed: " + res["error"].(string))
+		return
+	}
+	if status, res := adminCall(h, "POST", "/iterative_find_value", testToken,
+		map[string]string{"key": key}); status != http.StatusOK || res["value"] != "value" {
+		t.Error("iterative_find_value should return the stored value")
+	}
+
+	// files and keys travel in the body, base64 encoded
+	data := bytes.Repeat([]byte("file"), 10000)
+	status, res := adminCall(h, "POST", "/put_file", testToken, map[string][]byte{"file": data})
+	if status != http.StatusOK {
+		t.Error("put_file failed: " + res["error"].(string))
+		return
+	}
+	if status, res := adminCall(h, "POST", "/get_file", testToken,
+		map[string]string{"key": res["key"].(string)}); status != http.StatusOK {
+		t.Error("get_file failed")
+	} else if got, _ := base64.StdEncoding.DecodeString(res["file"].(string)); !bytes.Equal(got, data) {
+		t.Error("get_file should return the file stored with put_file")
+	}
+
+	status, res = adminCall(h, "POST", "/iterative_put_record", testToken, map[string]string{"value": "first"})
+	if status != http.StatusOK || res["seq"] != float64(1) || res["record_key"] == nil {
+		t.Error("iterative_put_record should store the first record under a new key")
+		return
+	}
+	seed, _ := base64.StdEncoding.DecodeString(res["record_key"].(string))
+	status, res = adminCall(h, "POST", "/iterative_put_record", testToken,
+		map[string]interface{}{"record_key": seed, "value": "record"})
+	if status != http.StatusOK || res["seq"] != float64(2) || res["record_key"] != nil {
+		t.Error("iterative_put_record should store the next record with the key given")
+	} else if status, res := adminCall(h, "POST", "/iterative_find_value", testToken,
+		map[string]string{"key": res["key"].(string)}); status != http.StatusOK || res["value"] != "record" {
+		t.Error("The record should be found under its key")
+	}
+
+	vdoID := kademlia.NewRandomID().AsString()
+	status, res = adminCall(h, "POST", "/vanish", testToken,
+		map[string]interface{}{"vdo_id": vdoID, "data": "vanishing", "number_keys": 5, "threshold": 3})
+	if status != http.StatusOK || res["stored"] != float64(5) {
+		t.Error("vanish should store every share")
+		return
+	}
+	status, res = adminCall(h, "POST", "/vanish_export", testToken,
+		map[string]interface{}{"vdo_id": vdoID, "binary": true})
+	if status != http.StatusOK || res["file"] == nil {
+		t.Error("vanish_export should return the binary VDO")
+		return
+	}
+	encoded, _ := base64.StdEncoding.DecodeString(res["file"].(string))
+	if status, res := adminCall(h, "POST", "/unvanish_import", testToken,
+		map[string][]byte{"file": encoded}); status != http.StatusOK || res["result"] != "OK, data =>\nvanishing" {
+		t.Error("unvanish_import should recover the data")
+	}
+	status, res = adminCall(h, "POST", "/vanish_export", testToken, map[string]string{"vdo_id": vdoID})
+	if status != http.StatusOK || res["vdo"] == nil {
+		t.Error("vanish_export should return the armored VDO")
+		return
+	}
+	armored := res["vdo"].(string)
+	if status, res := adminCall(h, "POST", "/unvanish", testToken,
+		map[string]string{"vdo": armored}); status != http.StatusOK || res["result"] != "OK, data =>\nvanishing" {
+		t.Error("unvanish should take the armored VDO")
+	}
+	vdo, _ := kademlia.ParseVDO([]byte(armored))
+	vdo.Ciphertext[len(vdo.Ciphertext)-1] ^= 1
+	if status, _ := adminCall(h, "POST", "/unvanish", testToken,
+		map[string]string{"vdo": string(kademlia.ArmorVDO(vdo))}); status != http.StatusUnprocessableEntity {
+		t.Error("A tampered VDO should fail with 422, got " + strconv.Itoa(status))
+	}
+	vdo.Ciphertext = []byte("not a ciphertext")
+	if status, _ := adminCall(h, "POST", "/unvanish", testToken,
+		map[string]string{"vdo": string(kademlia.ArmorVDO(vdo))}); status != http.StatusBadRequest {
+		t.Error("A VDO without a valid ciphertext should fail with 400, got " + strconv.Itoa(status))
+	}
+}
+
+// The token must not travel in the clear over the network.
+func TestAdminListen(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"localhost:8080": true,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"example.com:80": false,
+	} {
+		if isLoopback(addr) != ok {
+			t.Error(addr + ": loopback should be " + strconv.FormatBool(ok))
+		}
+	}
+	if err := ListenAndServe(":0", nil, testToken, "", ""); err == nil {
+		t.Error("Serving on every address without TLS should be refused")
+	}
+}
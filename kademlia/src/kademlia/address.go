@@ -0,0 +1,339 @@
+package kademlia
+
+// Contains the plumbing that lets the RPC server see the socket address a
+// request actually came from, and the logic a node uses to learn its own
+// external address from what its peers observe.
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strconv"
+)
+
+// how many distinct peers have to agree on an observed address before we
+// replace an already usable self address with it
+const addrQuorum = 2
+
+// Requests carrying a Sender implement this so the server codec can reconcile
+// the claimed contact with the observed remote address before the RPC method
+// sees it.
+type senderRequest interface {
+	sender() *Contact
+}
+
+func (m *PingMessage) sender() *Contact         { return &m.Sender }
+func (m *StoreRequest) sender() *Contact        { return &m.Sender }
+func (m *AppendRequest) sender() *Contact       { return &m.Sender }
+func (m *StoreRecordRequest) sender() *Contact  { return &m.Sender }
+func (m *FindNodeRequest) sender() *Contact     { return &m.Sender }
+func (m *FindValueRequest) sender() *Contact    { return &m.Sender }
+func (m *GetVDORequest) sender() *Contact       { return &m.Sender }
+func (m *ReachabilityRequest) sender() *Contact { return &m.Sender }
+
+// Requests that are told the address they came from, as opposed to the one
+// their sender claims.
+type observingRequest interface {
+	setObserved(ip net.IP)
+}
+
+func (m *PingMessage) setObserved(ip net.IP)         { m.observed = ip }
+func (m *ReachabilityRequest) setObserved(ip net.IP) { m.observed = ip }
+
+// The address a peer claims for itself is only a hint: the address we can
+// reach it on is the one its connection came from. The claimed port is kept,
+// since the observed one is the ephemeral port of the client side. A peer
+// that reached us over the other address family may not listen on it, so
+// then its claim stays the primary address and the observed one is only
+// added as an alternative.
+func reconcileContact(claimed *Contact, observed net.IP) {
+	if observed == nil {
+		return
+	}
+	claimed.setHost(observed)
+}
+
+// Every address the contact can be dialed on, the primary one first.
+func (c *Contact) Addresses() (ret []net.IP) {
+	if c.Host != nil {
+		ret = append(ret, c.Host)
+	}
+	return append(ret, c.AltHosts...)
+}
+
+// The usable address of the contact in the same family as ip, nil if there is
+// none.
+func (c *Contact) hostFor(ip net.IP) net.IP {
+	for _, host := range c.Addresses() {
+		if usableHost(host) && sameFamily(host, ip) {
+			return host
+		}
+	}
+	return nil
+}
+
+// Replace the address of the contact in the same family as ip, or add ip
+// when the contact had none of that family yet.
+func (c *Contact) setHost(ip net.IP) {
+	if !usableHost(c.Host) || sameFamily(c.Host, ip) {
+		c.Host = ip
+		return
+	}
+	// AltHosts may be shared with other copies of the contact
+	alts := []net.IP{}
+	for _, alt := range c.AltHosts {
+		if !sameFamily(alt, ip) {
+			alts = append(alts, alt)
+		}
+	}
+	c.AltHosts = append(alts, ip)
+}
+
+// Combine what we knew about a contact with a fresh sighting of it. The new
+// contact wins, but addresses of a family it does not mention are kept, so
+// a node reachable over both IPv4 and IPv6 keeps both in the routing table.
+func mergeContact(old, c Contact) Contact {
+	for _, host := range old.Addresses() {
+		if usableHost(host) && c.hostFor(host) == nil {
+			c.setHost(host)
+		}
+	}
+	return c
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// Resolve a hostname or IP literal to its addresses, IPv4 ones first so
+// that nodes only speaking IPv4 can still reach the first one.
+func ResolveHost(hostname string) ([]net.IP, error) {
+	if ip := net.ParseIP(hostname); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.LookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []net.IP{}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			hosts = append(hosts, ip)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("No address found for " + hostname)
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].To4() != nil && hosts[j].To4() == nil
+	})
+	return hosts, nil
+}
+
+// The first address of each family among hosts.
+func dualStack(hosts []net.IP) (ret []net.IP) {
+	for _, host := range hosts {
+		if len(ret) == 0 || (len(ret) == 1 && !sameFamily(ret[0], host)) {
+			ret = append(ret, host)
+		}
+	}
+	return
+}
+
+// Parse "host:port", "1.2.3.4:port" or "[::1]:port" into the first address
+// the host resolves to and the port.
+func ParseHostPort(addr string) (host net.IP, port uint16, err error) {
+	hostname, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+	hosts, err := ResolveHost(hostname)
+	if err != nil {
+		return
+	}
+	return hosts[0], uint16(p), nil
+}
+
+// Format an address as "1.2.3.4:port" or "[::1]:port".
+func JoinHostPort(host net.IP, port uint16) string {
+	return net.JoinHostPort(host.String(), strconv.Itoa(int(port)))
+}
+
+// Same as the gob codec net/rpc uses internally, plus the remote address of
+// the connection it is serving.
+type observingServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	remote net.IP
+	k      *Kademlia
+	method string
+	closed bool
+}
+
+func newObservingServerCodec(conn io.ReadWriteCloser, remote net.IP, k *Kademlia) *observingServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &observingServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		remote: remote,
+		k:      k,
+	}
+}
+
+func (c *observingServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.method = r.ServiceMethod
+	c.k.metrics.rpcReceived(r.ServiceMethod)
+	return nil
+}
+
+func (c *observingServerCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	peer := ""
+	if c.remote != nil {
+		peer = c.remote.String()
+	}
+	if req, ok := body.(senderRequest); ok {
+		reconcileContact(req.sender(), c.remote)
+		peer = req.sender().NodeID.AsString()
+	}
+	if req, ok := body.(observingRequest); ok {
+		req.setObserved(c.remote)
+	}
+	c.k.log.Debug("rpc received", rpcFields(c.method, peer, body)...)
+	return nil
+}
+
+func (c *observingServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// gob couldn't encode the header, should not happen
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the body could not be encoded, the connection is unusable
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *observingServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// Does what rpc.Server.ServeHTTP does, but serves the connection through an
+// observingServerCodec.
+type rpcHandler struct {
+	k *Kademlia
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := hijack(w, req)
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, connectedResponse)
+	var remote net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remote = addr.IP
+	}
+	h.k.server.ServeCodec(newObservingServerCodec(conn, remote, h.k))
+}
+
+// usableHost reports whether other nodes could dial us on host at all.
+func usableHost(host net.IP) bool {
+	return host != nil && !host.IsUnspecified()
+}
+
+// Whether one of our listeners accepts connections on ip's family. A
+// listener on :: takes both families.
+func (k *Kademlia) listensOn(ip net.IP) bool {
+	for _, l := range k.listeners {
+		addr := l.Addr().(*net.TCPAddr)
+		if sameFamily(addr.IP, ip) || (addr.IP.IsUnspecified() && addr.IP.To4() == nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record that peer saw our connection coming from observed and adopt it as
+// our own address for that family once enough peers agree. A family we have
+// no usable address for yet (such as 0.0.0.0 from listening on every
+// interface) is filled in on the first observation.
+func (k *Kademlia) observeSelfAddress(peer ID, observed net.IP) {
+	if observed == nil || observed.IsUnspecified() || !k.listensOn(observed) {
+		return
+	}
+	k.selfLock.Lock()
+	defer k.selfLock.Unlock()
+	current := k.SelfContact.hostFor(observed)
+	if current.Equal(observed) {
+		return
+	}
+	// a peer on the same machine tells us nothing about how the rest of
+	// the network sees us
+	if observed.IsLoopback() && current != nil && !current.IsLoopback() {
+		return
+	}
+	family := "6"
+	if observed.To4() != nil {
+		family = "4"
+	}
+	k.addrObservations[peer.AsString()+"/"+family] = observed
+	agree := 0
+	for _, ip := range k.addrObservations {
+		if ip.Equal(observed) {
+			agree++
+		}
+	}
+	if agree >= addrQuorum || current == nil {
+		k.log.Info("external address discovered", "addr", observed.String(), "agreeing_peers", agree)
+		k.SelfContact.setHost(observed)
+		for key, ip := range k.addrObservations {
+			if sameFamily(ip, observed) {
+				delete(k.addrObservations, key)
+			}
+		}
+	}
+}
+
+// Returns a copy of our own contact, safe to use while the external address
+// discovery may be updating it.
+func (k *Kademlia) selfContact() Contact {
+	k.selfLock.RLock()
+	defer k.selfLock.RUnlock()
+	return k.SelfContact
+}
+
+// Same as selfContact, for users of the package: SelfContact must not be
+// read directly once the node is running.
+func (k *Kademlia) Self() Contact {
+	return k.selfContact()
+}
@@ -0,0 +1,147 @@
+package kademlia
+
+// Contains the content layer storing blobs too large for a single STORE. A
+// blob is split into chunks, each stored content-addressed, and a manifest
+// listing the chunks is stored content-addressed too. The manifest key is all
+// that is needed to get the blob back, and every piece fetched is checked
+// against the hash it is stored under.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ChunkSize      = 16 * 1024
+	manifestHeader = "kademlia-manifest 1"
+)
+
+type ChunkRef struct {
+	Key  ID
+	Size int
+}
+
+type Manifest struct {
+	Size   int
+	Chunks []ChunkRef
+}
+
+// The manifest is plain text so it can be inspected with find_value:
+//
+//	kademlia-manifest 1
+//	size <bytes>
+//	chunk <key> <bytes>
+//	...
+func (m *Manifest) Encode() []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%s\nsize %d\n", manifestHeader, m.Size)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(&buffer, "chunk %s %d\n", c.Key.AsString(), c.Size)
+	}
+	return buffer.Bytes()
+}
+
+func DecodeManifest(data []byte) (*Manifest, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		return nil, errors.New("Not a manifest")
+	}
+	m := new(Manifest)
+	if !scanner.Scan() {
+		return nil, errors.New("Manifest has no size")
+	}
+	if _, err := fmt.Sscanf(scanner.Text(), "size %d", &m.Size); err != nil {
+		return nil, errors.New("Invalid manifest size: " + err.Error())
+	}
+	total := 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "chunk" {
+			return nil, errors.New("Invalid manifest line: " + scanner.Text())
+		}
+		key, err := IDFromString(fields[1])
+		if err != nil {
+			return nil, errors.New("Invalid chunk key: " + fields[1])
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size < 0 || size > ChunkSize {
+			return nil, errors.New("Invalid chunk size: " + fields[2])
+		}
+		m.Chunks = append(m.Chunks, ChunkRef{key, size})
+		total += size
+	}
+	if total != m.Size {
+		return nil, errors.New("Manifest chunks do not add up to its size")
+	}
+	return m, nil
+}
+
+// Store value content-addressed on the k closest nodes to its key, failing if
+// none accepted it.
+func (k *Kademlia) storeValue(value []byte) (ID, error) {
+	_, key, stored := k.DoIterativeStoreContent(value)
+	if len(stored) == 0 {
+		return key, errors.New("No node stored " + key.AsString())
+	}
+	return key, nil
+}
+
+// Look up the value stored under key, skipping peers whose value does not
+// hash to key.
+func (k *Kademlia) findVerified(key ID) ([]byte, error) {
+	resp := k.internalIterative(key, true, true, nil)
+	if resp.value == nil {
+		return nil, errors.New("Key(" + key.AsString() + ") not found")
+	}
+	return resp.value, nil
+}
+
+// Store data as chunks plus a manifest, and return the manifest key.
+func (k *Kademlia) PutBlob(data []byte) (ID, error) {
+	m := &Manifest{Size: len(data)}
+	for start := 0; start < len(data); start += ChunkSize {
+		end := start + ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[start:end]
+		key, err := k.storeValue(chunk)
+		if err != nil {
+			return ID{}, err
+		}
+		m.Chunks = append(m.Chunks, ChunkRef{key, len(chunk)})
+	}
+	key, err := k.storeValue(m.Encode())
+	if err != nil {
+		return ID{}, err
+	}
+	return key, nil
+}
+
+// Fetch the manifest stored under key and reassemble the blob it lists.
+func (k *Kademlia) GetBlob(key ID) ([]byte, error) {
+	manifest, err := k.findVerified(key)
+	if err != nil {
+		return nil, err
+	}
+	m, err := DecodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, m.Size)
+	for idx, c := range m.Chunks {
+		chunk, err := k.findVerified(c.Key)
+		if err != nil {
+			return nil, errors.New("Chunk " + strconv.Itoa(idx) + ": " + err.Error())
+		}
+		if len(chunk) != c.Size {
+			return nil, errors.New("Chunk " + strconv.Itoa(idx) + " has the wrong size")
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
@@ -4,6 +4,7 @@ package kademlia
 
 import (
 	"crypto/md5"
+	"crypto/sha1"
 	"encoding/hex"
 	"math/rand"
 )
@@ -95,3 +96,9 @@ func IDFromString(idstr string) (ret ID, err error) {
 func Checksum(data []byte) [16]byte {
 	return md5.Sum(data)
 }
+
+// The key of a value in content-addressed mode: its SHA-1, which is exactly
+// the size of an ID.
+func ContentID(data []byte) ID {
+	return ID(sha1.Sum(data))
+}
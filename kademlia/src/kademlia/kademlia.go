@@ -7,37 +7,72 @@ import (
 	"bytes"
 	"container/heap"
 	"container/list"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/rpc"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	alpha = 3
 	B     = 8 * IDBytes
 	K     = 20
+	// how long an RPC may take before it is given up on
+	RPCTimeout = 5 * time.Second
 )
 
 type Storage interface {
 	Get(key ID) (interface{}, bool)
 	Put(key ID, value interface{}) bool
+	Stats() (keys int, bytes int)
+	// delete the values whose TTL is over
+	Expire(now time.Time) (deleted int)
 }
 
 // Kademlia type. You can put whatever state you need in this.
 type Kademlia struct {
-	NodeID         ID
-	SelfContact    Contact
-	updateChannel  chan Contact
-	findChannel    chan routingRequest
-	getLastChannel chan routingRequest
-	routingTable   []*KBucket
-	storage        Storage
-	vdoStorage     Storage
-	server         *rpc.Server
-	listener       net.Listener
+	NodeID            ID
+	SelfContact       Contact
+	selfLock          sync.RWMutex
+	addrObservations  map[string]net.IP
+	updateChannel     chan Contact
+	findChannel       chan routingRequest
+	getLastChannel    chan routingRequest
+	bucketSizeChannel chan routingRequest
+	failureChannel    chan ID
+	misbehaveChannel  chan ID
+	snapshotChannel   chan routingRequest
+	contactStats      map[string]*contactStats
+	banned            map[string]time.Time
+	routingTable      []*KBucket
+	storage           Storage
+	vdoStorage        Storage
+	vdos              *VDOManager
+	valueSets         *ValueSetStorage
+	records           *RecordStorage
+	storeLock         sync.Mutex
+	server            *rpc.Server
+	mux               *http.ServeMux
+	listeners         []net.Listener
+	relayLock         sync.Mutex
+	relayed           map[string]*rpc.Client
+	relayPending      map[string]chan net.Conn
+	dialBacks         dialBackLimiter
+	metrics           *Metrics
+	log               *slog.Logger
+	// how many of the closest nodes have to agree on the newest version of
+	// a value read with DoIterativeFindValue
+	ReadQuorum int
+	// how many of the closest nodes have to accept a value for an iterative
+	// store to succeed
+	WriteQuorum int
+	rpcTimeout  time.Duration
 }
 
 type routingRequest struct {
@@ -53,7 +88,12 @@ type probeResult struct {
 	Result         bool
 }
 
-func NewKademlia(laddr string, nodeId *ID) *Kademlia {
+func NewKademlia(laddr string, nodeId *ID) (*Kademlia, error) {
+	return NewKademliaWithLogger(laddr, nodeId, slog.Default())
+}
+
+// Same as NewKademlia, logging to logger instead of the default slog logger.
+func NewKademliaWithLogger(laddr string, nodeId *ID, logger *slog.Logger) (*Kademlia, error) {
 	// TODO: Initialize other state here as you add functionality.
 	k := new(Kademlia)
 	if nodeId != nil {
@@ -61,6 +101,7 @@ func NewKademlia(laddr string, nodeId *ID) *Kademlia {
 	} else {
 		k.NodeID = NewRandomID()
 	}
+	k.log = logger.With("node_id", k.NodeID.AsString())
 	k.updateChannel = make(chan Contact, 10)
 	k.routingTable = make([]*KBucket, B)
 	for ii, _ := range k.routingTable {
@@ -68,8 +109,24 @@ func NewKademlia(laddr string, nodeId *ID) *Kademlia {
 	}
 	k.findChannel = make(chan routingRequest)
 	k.getLastChannel = make(chan routingRequest)
+	k.bucketSizeChannel = make(chan routingRequest)
+	k.failureChannel = make(chan ID, 10)
+	k.misbehaveChannel = make(chan ID, 10)
+	k.banned = make(map[string]time.Time)
+	k.snapshotChannel = make(chan routingRequest)
+	k.contactStats = make(map[string]*contactStats)
+	k.metrics = NewMetrics()
 	k.storage = NewLocalStorage()
 	k.vdoStorage = NewLocalStorage()
+	k.vdos = NewVDOManager(k)
+	k.valueSets = NewValueSetStorage()
+	k.records = NewRecordStorage()
+	k.ReadQuorum = 1
+	k.WriteQuorum = 1
+	k.rpcTimeout = RPCTimeout
+	k.addrObservations = make(map[string]net.IP)
+	k.relayed = make(map[string]*rpc.Client)
+	k.relayPending = make(map[string]chan net.Conn)
 
 	// Set up RPC server
 	// NOTE: KademliaCore is just a wrapper around Kademlia. This type includes
@@ -84,37 +141,65 @@ func NewKademlia(laddr string, nodeId *ID) *Kademlia {
 	*/
 	s := rpc.NewServer()
 	s.Register(&KademliaCore{k})
-	_, port, _ := net.SplitHostPort(laddr)                           // extract just the port number
-	s.HandleHTTP(rpc.DefaultRPCPath+port, rpc.DefaultDebugPath+port) // I'm making a unique RPC path for this instance of Kademlia
+	k.server = s
+	hostname, port, _ := net.SplitHostPort(laddr) // extract just the port number
+	// I'm making a unique RPC path for this instance of Kademlia. Each
+	// instance has its own mux so the handler can see the remote address of
+	// every connection.
+	k.mux = http.NewServeMux()
+	k.mux.Handle(rpc.DefaultRPCPath+port, &rpcHandler{k})
+	k.mux.HandleFunc(MetricsPath, k.serveMetrics)
+	k.mux.HandleFunc(relayControlPath, k.serveRelayControl)
+	k.mux.HandleFunc(relayPath, k.serveRelay)
+	k.mux.HandleFunc(relayBackPath, k.serveRelayBack)
 
-	l, err := net.Listen("tcp", laddr)
-	if err != nil {
-		log.Fatal("Listen: ", err)
+	// A hostname resolving to both an IPv4 and an IPv6 address gets a listener
+	// for each family; an empty or unspecified host already listens on both.
+	addrs := []string{laddr}
+	if hostname != "" {
+		hosts, err := ResolveHost(hostname)
+		if err != nil {
+			return nil, err
+		}
+		addrs = []string{}
+		for _, host := range dualStack(hosts) {
+			addrs = append(addrs, net.JoinHostPort(host.String(), port))
+		}
+	}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			k.Close()
+			return nil, err
+		}
+		k.log.Info("listening", "addr", l.Addr().String())
+		k.listeners = append(k.listeners, l)
+		// Run RPC server forever.
+		go http.Serve(l, k.mux)
 	}
-	k.listener = l
-	// Run RPC server forever.
-	go http.Serve(l, nil)
-	k.server = s
 
-	// Add self contact
-	hostname, port, _ := net.SplitHostPort(l.Addr().String())
-	port_int, _ := strconv.Atoi(port)
-	ipAddrStrings, err := net.LookupHost(hostname)
-	var host net.IP
-	for i := 0; i < len(ipAddrStrings); i++ {
-		host = net.ParseIP(ipAddrStrings[i])
-		if host.To4() != nil {
-			break
+	// Add self contact. When listening on every interface this is only a
+	// placeholder (0.0.0.0 or ::) until peers tell us how they see us, see
+	// observeSelfAddress.
+	for _, l := range k.listeners {
+		addr := l.Addr().(*net.TCPAddr)
+		if k.SelfContact.Host == nil {
+			k.SelfContact = Contact{NodeID: k.NodeID, Host: addr.IP, Port: uint16(addr.Port)}
+		} else {
+			k.SelfContact.AltHosts = append(k.SelfContact.AltHosts, addr.IP)
 		}
 	}
-	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
 	//fmt.Println("My ID: " + k.NodeID.AsString())
 	go k.handleUpdate()
-	return k
+	go k.expireValues()
+	go k.vdos.run()
+	return k, nil
 }
 
 func (k *Kademlia) Close() {
-	_ = k.listener.Close()
+	for _, l := range k.listeners {
+		_ = l.Close()
+	}
 }
 
 type ContactHeap struct {
@@ -151,6 +236,15 @@ func minContact(c1, c2 Contact, key ID) Contact {
 	return c2
 }
 
+// Whether con could be one of the K closest nodes to key, given the nodes
+// found active so far.
+func amongClosest(con Contact, active []Contact, key ID) bool {
+	if len(active) < K {
+		return true
+	}
+	return contactLess(&con, &sortedContacts(active, key)[K-1], key)
+}
+
 func (h ContactHeap) Less(ii, jj int) bool {
 	return contactLess(&h.List[ii], &h.List[jj], h.NodeID)
 }
@@ -187,21 +281,37 @@ func (k *Kademlia) handleUpdate() {
 				//fmt.Println("**update the self NodeID")
 				break
 			}
+			if until, ok := k.banned[c.NodeID.AsString()]; ok {
+				if time.Now().Before(until) {
+					break
+				}
+				delete(k.banned, c.NodeID.AsString())
+			}
 			idx := k.NodeID.Xor(c.NodeID).PrefixLen()
 			if idx < B {
 				ct, _ := k.routingTable[idx].FindContact(c.NodeID)
-				if ct != nil {
+				if c.ClientOnly {
+					// nobody can dial it, so it must not be handed out
+					if ct != nil {
+						k.routingTable[idx].Remove(ct)
+						delete(k.contactStats, c.NodeID.AsString())
+					}
+				} else if ct != nil {
+					ct.Value = mergeContact(ct.Value.(Contact), c)
 					k.routingTable[idx].MoveToBack(ct)
+					k.contactSeen(c.NodeID)
 				} else {
 					if k.routingTable[idx].Full() {
 						head := k.routingTable[idx].Front()
 						hc := head.Value.(Contact)
 						go func() {
-							_, ok := k.internalPing(hc.Host, hc.Port, false)
+							_, ok := k.pingContact(&hc, false)
 							responseChannel <- probeResult{k.routingTable[idx], head, &c, ok}
 						}()
 					} else {
+						k.log.Debug("contact added", "peer", c.NodeID.AsString(), "bucket", idx)
 						k.routingTable[idx].PushBack(c)
+						k.contactSeen(c.NodeID)
 					}
 				}
 
@@ -252,16 +362,44 @@ func (k *Kademlia) handleUpdate() {
 				get.Count -= 1
 			}
 			get.ResponseChannel.(chan []Contact) <- respList
+		case sizes := <-k.bucketSizeChannel:
+			ret := make([]int, B)
+			for idx, bucket := range k.routingTable {
+				ret[idx] = bucket.Len()
+			}
+			sizes.ResponseChannel.(chan []int) <- ret
 		// TODO: handle ping response
 		case res := <-responseChannel:
+			probed := res.ProbeContact.Value.(Contact)
 			if res.Result {
 				//fmt.Println("result true")
 				res.TargetKBucket.MoveToBack(res.ProbeContact)
+				k.contactSeen(probed.NodeID)
 			} else {
 				//fmt.Println("result false")
+				k.log.Debug("contact evicted", "peer", probed.NodeID.AsString(),
+					"replacement", res.ReplaceContact.NodeID.AsString())
 				res.TargetKBucket.Remove(res.ProbeContact)
-				res.TargetKBucket.PushBack(res.ReplaceContact)
+				delete(k.contactStats, probed.NodeID.AsString())
+				res.TargetKBucket.PushBack(*res.ReplaceContact)
+				k.contactSeen(res.ReplaceContact.NodeID)
 			}
+		case id := <-k.failureChannel:
+			if stats, ok := k.contactStats[id.AsString()]; ok {
+				stats.Failures++
+			}
+		case id := <-k.misbehaveChannel:
+			idx := k.NodeID.Xor(id).PrefixLen()
+			if idx < B {
+				if ct, _ := k.routingTable[idx].FindContact(id); ct != nil {
+					k.log.Debug("contact evicted", "peer", id.AsString(), "reason", "misbehaved")
+					k.routingTable[idx].Remove(ct)
+				}
+			}
+			delete(k.contactStats, id.AsString())
+			k.banned[id.AsString()] = time.Now().Add(misbehaviorBan)
+		case snapshot := <-k.snapshotChannel:
+			snapshot.ResponseChannel.(chan []BucketSnapshot) <- k.snapshotRoutingTable()
 		}
 	}
 }
@@ -305,11 +443,21 @@ func (k *Kademlia) getLastContactFromRoutingTable(nodeId ID) (ret []Contact) {
 	return
 }
 
+// Every contact in the routing table, closest to us first.
+func (k *Kademlia) Contacts() (ret []Contact) {
+	resCh := make(chan []Contact)
+	k.getLastChannel <- routingRequest{k.NodeID, B * K, resCh}
+	ret = <-resCh
+	close(resCh)
+	return
+}
+
 func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	// TODO: Search through contacts, find specified ID
 	// Find contact with provided ID
-	if nodeId == k.SelfContact.NodeID {
-		return &k.SelfContact, nil
+	if nodeId == k.NodeID {
+		self := k.selfContact()
+		return &self, nil
 	}
 	ct := k.findContactFromKRoutingTable(nodeId)
 	if ct != nil {
@@ -319,18 +467,55 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 }
 
 func GetClient(host net.IP, port uint16) *rpc.Client {
-	peerStr := host.String() + ":" + strconv.Itoa(int(port))
+	peerStr := JoinHostPort(host, port)
 	//fmt.Println("peerstr:" + peerStr)
 	//client, err := rpc.DialHTTP("tcp", peerStr)
-	client, err := rpc.DialHTTPPath("tcp", peerStr, rpc.DefaultRPCPath+strconv.Itoa(int(port)))
+	conn, err := dialConnect(peerStr, rpc.DefaultRPCPath+strconv.Itoa(int(port)))
 	if err != nil {
 		return nil
 	}
+	return rpc.NewClient(conn)
+}
+
+// Dial a contact on each of the addresses it advertises until one of them
+// answers. A contact behind a relay is dialed through the relay first.
+func GetContactClient(contact *Contact) *rpc.Client {
+	for _, relay := range contact.Relays {
+		if client := getRelayedClient(relay, contact.NodeID); client != nil {
+			return client
+		}
+	}
+	for _, host := range contact.Addresses() {
+		if client := GetClient(host, contact.Port); client != nil {
+			return client
+		}
+	}
+	return nil
+}
+
+// Same as GetContactClient, counting a failure against the contact when it
+// cannot be dialed.
+func (k *Kademlia) dialContact(contact *Contact) *rpc.Client {
+	client := GetContactClient(contact)
+	if client == nil {
+		k.contactFailed(contact.NodeID)
+	}
 	return client
 }
 
 func (k *Kademlia) internalPing(host net.IP, port uint16, update bool) (id ID, ok bool) {
-	client := GetClient(host, port)
+	return k.ping(GetClient(host, port), JoinHostPort(host, port), update)
+}
+
+func (k *Kademlia) pingContact(contact *Contact, update bool) (id ID, ok bool) {
+	id, ok = k.ping(GetContactClient(contact), contact.NodeID.AsString(), update)
+	if !ok {
+		k.contactFailed(contact.NodeID)
+	}
+	return
+}
+
+func (k *Kademlia) ping(client *rpc.Client, peer string, update bool) (id ID, ok bool) {
 	ok = true
 	if client == nil {
 		ok = false
@@ -338,15 +523,16 @@ func (k *Kademlia) internalPing(host net.IP, port uint16, update bool) (id ID, o
 	}
 	defer client.Close()
 	pingReq := new(PingMessage)
-	pingReq.Sender = k.SelfContact
+	pingReq.Sender = k.selfContact()
 	pingReq.MsgID = NewRandomID()
 	var pong PongMessage
-	err := client.Call("KademliaCore.Ping", pingReq, &pong)
+	err := k.call(client, peer, "KademliaCore.Ping", pingReq, &pong)
 	if err != nil {
 		ok = false
 		return
 	}
 	id = pong.Sender.NodeID
+	k.observeSelfAddress(id, pong.Observed)
 	if update {
 		k.updateChannel <- pong.Sender
 	}
@@ -360,38 +546,48 @@ func (k *Kademlia) DoPing(host net.IP, port uint16) string {
 	//return "ERR: Not implemented"
 	id, ok := k.internalPing(host, port, true)
 	if ok {
-		return host.String() + ":" + strconv.Itoa(int(port)) + " has NodeID: " + id.AsString()
+		return JoinHostPort(host, port) + " has NodeID: " + id.AsString()
 	}
 	return "Failed to ping"
 }
 
-func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
-	// TODO: Implement
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	//return "ERR: Not implemented"
-	client := GetClient(contact.Host, contact.Port)
+// If contentAddressed is set, the receiver rejects the value unless key is
+// its ContentID. Replicas of a value are written with the same version. A
+// positive ttl has the receiver delete the value once it is over.
+func (k *Kademlia) internalStore(contact *Contact, key ID, value []byte, version int64, ttl time.Duration, contentAddressed bool) error {
+	client := k.dialContact(contact)
 	if client == nil {
-		return "Failed to connect to " + contact.NodeID.AsString()
+		return errors.New("Failed to connect to " + contact.NodeID.AsString())
 	}
 	defer client.Close()
-	req := new(StoreRequest)
-	req.Sender = k.SelfContact
-	req.MsgID = NewRandomID()
-	req.Key = key
-	req.Value = value
+	req := StoreRequest{k.selfContact(), NewRandomID(), key, value, contentAddressed, version, ttl}
 	var res StoreResult
-	err := client.Call("KademliaCore.Store", req, &res)
-	if err != nil {
-		return "ERR: Store on " + contact.NodeID.AsString() + "(" + contact.Host.String() + ":" + strconv.Itoa(int(contact.Port)) + ") : " + err.Error()
+	err := k.call(client, contact.NodeID.AsString(), "KademliaCore.Store", req, &res)
+	if _, refused := err.(rpc.ServerError); err != nil && !refused {
+		k.contactFailed(contact.NodeID)
 	}
-	if !res.MsgID.Equals(req.MsgID) || res.Err != nil {
-		return "ERR: Remote Store on " + contact.NodeID.AsString() + "(" + contact.Host.String() + ":" + strconv.Itoa(int(contact.Port)) + ") : " + err.Error()
+	if err == nil && !res.MsgID.Equals(req.MsgID) {
+		err = errors.New("Mismatched message ID")
+	}
+	if err == nil && res.Err != nil {
+		err = res.Err
+	}
+	return err
+}
+
+func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
+	// TODO: Implement
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	//return "ERR: Not implemented"
+	err := k.internalStore(contact, key, value, time.Now().UnixNano(), 0, false)
+	if err != nil {
+		return "ERR: Store on " + contact.NodeID.AsString() + "(" + JoinHostPort(contact.Host, contact.Port) + ") : " + err.Error()
 	}
 	return "OK: " + contact.NodeID.AsString()
 }
 
 func (k *Kademlia) internalFindNode(contact *Contact, searchKey ID) (res FindNodeResult, ok bool) {
-	client := GetClient(contact.Host, contact.Port)
+	client := k.dialContact(contact)
 	if client == nil {
 		//fmt.Println("Failed to connect to " + contact.NodeID.AsString())
 		ok = false
@@ -399,14 +595,15 @@ func (k *Kademlia) internalFindNode(contact *Contact, searchKey ID) (res FindNod
 	}
 	defer client.Close()
 	req := new(FindNodeRequest)
-	req.Sender = k.SelfContact
+	req.Sender = k.selfContact()
 	req.MsgID = NewRandomID()
 	req.NodeID = searchKey
-	err := client.Call("KademliaCore.FindNode", req, &res)
+	err := k.call(client, contact.NodeID.AsString(), "KademliaCore.FindNode", req, &res)
 	//	fmt.Println("res non nil00")
 	if err != nil || !req.MsgID.Equals(res.MsgID) {
 		//		fmt.Println("res non nil11")
 		//fmt.Println("Call error when calling FindNode remotely: ", contact.NodeID.AsString())
+		k.contactFailed(contact.NodeID)
 		ok = false
 		return
 	}
@@ -433,13 +630,14 @@ func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) (string, []Contact
 	}
 	var buffer bytes.Buffer
 	for idx, val := range res.Nodes {
-		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + val.NodeID.AsString() + " => " + val.Host.String() + ":" + strconv.Itoa(int(val.Port)))
+		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + val.NodeID.AsString() + " => " + JoinHostPort(val.Host, val.Port))
 	}
 	return "OK: FindNode result =>" + buffer.String(), res.Nodes
 }
 
-func (k *Kademlia) internalFindValue(contact *Contact, searchKey ID) (res FindValueResult, ok bool) {
-	client := GetClient(contact.Host, contact.Port)
+// offset is the first value wanted when searchKey holds appended values.
+func (k *Kademlia) internalFindValue(contact *Contact, searchKey ID, offset int) (res FindValueResult, ok bool) {
+	client := k.dialContact(contact)
 	if client == nil {
 		//fmt.Println("Failed to connect to " + contact.NodeID.AsString())
 		ok = false
@@ -447,12 +645,14 @@ func (k *Kademlia) internalFindValue(contact *Contact, searchKey ID) (res FindVa
 	}
 	defer client.Close()
 	req := new(FindValueRequest)
-	req.Sender = k.SelfContact
+	req.Sender = k.selfContact()
 	req.MsgID = NewRandomID()
 	req.Key = searchKey
-	err := client.Call("KademliaCore.FindValue", req, &res)
+	req.Offset = offset
+	err := k.call(client, contact.NodeID.AsString(), "KademliaCore.FindValue", req, &res)
 	if err != nil || !req.MsgID.Equals(res.MsgID) {
 		//fmt.Println("Call error when calling FindNode remotely: ", contact.NodeID.AsString())
+		k.contactFailed(contact.NodeID)
 		ok = false
 		return
 	}
@@ -471,16 +671,21 @@ func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) (string, []byte,
 	// TODO: Implement
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
 	//return "ERR: Not implemented"
-	res, ok := k.internalFindValue(contact, searchKey)
+	res, ok := k.internalFindValue(contact, searchKey, 0)
 	if !ok {
 		return "ERR: FindValue failed: " + searchKey.AsString(), nil, nil
 	}
 	var buffer bytes.Buffer
 	if res.Value != nil {
 		buffer.WriteString(" Value = " + string(res.Value))
+	} else if res.Total > 0 {
+		buffer.WriteString(" " + strconv.Itoa(res.Total) + " values")
+		for idx, val := range k.fetchValues(*contact, searchKey, res.Values, res.Total) {
+			buffer.WriteString("\n[" + strconv.Itoa(idx) + "] " + string(val))
+		}
 	} else {
 		for idx, val := range res.Nodes {
-			buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + val.NodeID.AsString() + " => " + val.Host.String() + ":" + strconv.Itoa(int(val.Port)))
+			buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + val.NodeID.AsString() + " => " + JoinHostPort(val.Host, val.Port))
 		}
 	}
 	return "OK: FindValue result =>" + buffer.String(), res.Value, res.Nodes
@@ -490,11 +695,18 @@ func (k *Kademlia) LocalFindValue(searchKey ID) (string, []byte) {
 	// TODO: Implement
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
 	//return "ERR: Not implemented"
+	if r, ok := k.records.Get(searchKey); ok {
+		return "OK: " + searchKey.AsString() + "(" + string(r.Value) + ") seq " + strconv.FormatUint(r.Seq, 10), r.Value
+	}
 	ires, ok := k.storage.Get(searchKey)
 	if ok {
-		res := ires.([]byte)
+		res := ires.(StoredValue).Value
 		return "OK: " + searchKey.AsString() + "(" + string(res) + ")", res
 	}
+	values, total := k.valueSets.GetPage(searchKey, 0, maxValuesPerKey)
+	if total > 0 {
+		return "OK: " + searchKey.AsString() + string(formatValues(values)), nil
+	}
 	return "ERR: Key(" + searchKey.AsString() + ") not found", nil
 }
 
@@ -503,22 +715,66 @@ type iterativeResult struct {
 	target            Contact
 	activeContactList []Contact
 	value             []byte
+	// a page of the values of a key holding appended values, and how many
+	// it holds in all
+	values [][]byte
+	total  int
+	record *SignedRecord
+	// set when the value was discarded, the contacts of the peer being
+	// still usable
+	rejected bool
+	latency  time.Duration
+}
+
+func (r *iterativeResult) found() bool {
+	return r.value != nil || r.total > 0 || r.record != nil
 }
 
-func (k *Kademlia) doFind(target Contact, key ID, findValue bool, respCh chan iterativeResult) {
+func (k *Kademlia) doFind(target Contact, key ID, findValue bool, verify bool, respCh chan iterativeResult) {
 	res := iterativeResult{
 		success:           false,
 		target:            target,
 		activeContactList: []Contact{},
 		value:             nil,
 	}
+	start := time.Now()
 	if findValue {
 		//		fmt.Println("calling internalFindNode")
-		resp, ok := k.internalFindValue(&target, key)
+		resp, ok := k.internalFindValue(&target, key, 0)
+		var err error
+		misbehaved := false
+		if resp.Record != nil {
+			// records are verified when stored, so no one else could have
+			// made it hold an invalid one
+			err = resp.Record.Verify(key)
+			misbehaved = err != nil
+		}
+		// but anyone can store or append a value under any key
+		if err == nil && verify && (resp.Total > 0 || resp.Record != nil || (resp.Value != nil && !ContentID(resp.Value).Equals(key))) {
+			err = errors.New("Value does not match content key")
+		}
+		if ok && err != nil {
+			k.log.Warn("invalid value", "peer", target.NodeID.AsString(), "key", key.AsString(), "err", err)
+			if misbehaved {
+				k.contactMisbehaved(target.NodeID)
+			}
+			ok = false
+			// the lookup may have no other way forward: its contacts will
+			// be checked when queried
+			if nodes, found := k.internalFindNode(&target, key); found {
+				res.rejected = true
+				res.activeContactList = nodes.Nodes
+			}
+		}
 		if ok {
 			res.success = true
-			if resp.Value != nil {
+			if resp.Record != nil {
+				res.record = resp.Record
+			} else if resp.Value != nil {
 				res.value = resp.Value
+			} else if resp.Total > 0 {
+				res.values = resp.Values
+				res.total = resp.Total
 			} else if resp.Nodes != nil {
 				res.activeContactList = append(res.activeContactList, resp.Nodes...)
 			}
@@ -532,64 +788,85 @@ func (k *Kademlia) doFind(target Contact, key ID, findValue bool, respCh chan it
 			}
 		}
 	}
+	res.latency = time.Since(start)
 	respCh <- res
 }
 
-func (k *Kademlia) internalIterative(key ID, findValue bool) (ret iterativeResult) {
+// If verify is set, key is content-addressed and values not hashing to it are
+// rejected. trace may be nil, otherwise every round of the lookup is recorded
+// in it.
+func (k *Kademlia) internalIterative(key ID, findValue bool, verify bool, trace *LookupTrace) (ret iterativeResult) {
 	ret.success = true
-	ret.target = k.SelfContact
+	ret.target = k.selfContact()
 	ret.activeContactList = nil
 	ret.value = nil
 
 	shortList := k.getLastContactFromRoutingTable(key)
 	if shortList == nil || len(shortList) == 0 {
+		if trace != nil {
+			trace.Termination = TerminatedEmptyTable
+		}
 		return
 	}
-	lastClosestNode := k.SelfContact
+	rounds := 0
+	start := time.Now()
+	defer func() {
+		k.metrics.lookupDone(rounds, time.Since(start))
+	}()
+	lastClosestNode := k.selfContact()
 	closestNode := shortList[0]
 	activeNodes := []Contact{}
 	nodesMap := make(map[string]bool)
 
-	if len(shortList) > 3 {
-		shortList = shortList[:alpha]
-	}
 	// add short list nodes to set
 	for _, con := range shortList {
 		nodesMap[con.NodeID.AsString()] = true
 	}
 	cHeap := &ContactHeap{shortList, key}
 	heap.Init(cHeap)
+	// add the contacts we have not seen yet to the heap
+	addContacts := func(contacts []Contact) {
+		for _, con := range contacts {
+			if _, ok := nodesMap[con.NodeID.AsString()]; !ok {
+				nodesMap[con.NodeID.AsString()] = true
+				heap.Push(cHeap, con)
+			}
+		}
+	}
 
 	// iterative loop
-	for !closestNode.NodeID.Equals(lastClosestNode.NodeID) && len(activeNodes) < K && ret.value == nil && cHeap.Len() > 0 {
+	for !closestNode.NodeID.Equals(lastClosestNode.NodeID) && len(activeNodes) < K && !ret.found() && cHeap.Len() > 0 {
 		var parallel int
+		rounds++
 		respChannel := make(chan iterativeResult)
 		for parallel = 0; parallel < alpha && cHeap.Len() > 0; parallel++ {
 			con := heap.Pop(cHeap).(Contact)
 			//fmt.Println(strconv.Itoa(parallel) + " 0=> " + con.NodeID.AsString())
-			go k.doFind(con, key, findValue, respChannel)
+			go k.doFind(con, key, findValue, verify, respChannel)
 			//fmt.Println(strconv.Itoa(parallel) + " 1=> " + con.NodeID.AsString())
 		}
 		//fmt.Println(strconv.Itoa(parallel) + " hehe ***")
+		responses := []iterativeResult{}
 		for count := 0; count < parallel; count++ {
 			resp := <-respChannel
+			responses = append(responses, resp)
 			if resp.success {
 				activeNodes = append(activeNodes, resp.target)
-				if findValue && resp.value != nil {
+				if findValue && resp.found() {
 					//					fmt.Println(" => " + resp.target.NodeID.AsString())
 					// only accept the first time assignment
-					if ret.value == nil {
+					if !ret.found() {
 						ret.target = resp.target
 						ret.value = resp.value
+						ret.values = resp.values
+						ret.total = resp.total
+						ret.record = resp.record
 					}
 				} else if resp.activeContactList != nil {
-					for _, con := range resp.activeContactList {
-						if _, ok := nodesMap[con.NodeID.AsString()]; !ok {
-							nodesMap[con.NodeID.AsString()] = true
-							heap.Push(cHeap, con)
-						}
-					}
+					addContacts(resp.activeContactList)
 				}
+			} else if resp.rejected {
+				addContacts(resp.activeContactList)
 			}
 		}
 		lastClosestNode = closestNode
@@ -599,32 +876,63 @@ func (k *Kademlia) internalIterative(key ID, findValue bool) (ret iterativeResul
 			closestNode = minContact(closestNode, currentMin, key)
 		}
 		close(respChannel)
+		if trace != nil {
+			trace.addRound(false, responses, cHeap)
+		}
+	}
+	// why the iterative loop stopped, unless the last round finds the value
+	var termination string
+	switch {
+	case len(activeNodes) >= K:
+		termination = TerminatedKActive
+	case cHeap.Len() == 0:
+		termination = TerminatedExhausted
+	default:
+		termination = TerminatedNoProgress
 	}
 
-	if len(activeNodes) < K {
-		if findValue && ret.value != nil {
-			ret.activeContactList = nil
-		} else {
-			// TODO: query all the uncontacted contacts
-			queryCount := 0
-			respChannel := make(chan iterativeResult)
-			for cHeap.Len() > 0 {
-				con := heap.Pop(cHeap).(Contact)
-				go k.doFind(con, key, findValue, respChannel)
-				queryCount++
-			}
-			for idx := 0; idx < queryCount; idx++ {
-				resp := <-respChannel
-				if resp.success {
-					activeNodes = append(activeNodes, resp.target)
-					if findValue && resp.value != nil {
-						ret.value = resp.value
-					}
+	// query the contacts left that may be among the K closest, following the
+	// closer ones they return until none is left
+	for !(findValue && ret.found()) && cHeap.Len() > 0 && amongClosest(cHeap.List[0], activeNodes, key) {
+		rounds++
+		queryCount := 0
+		respChannel := make(chan iterativeResult)
+		for queryCount < K && cHeap.Len() > 0 && amongClosest(cHeap.List[0], activeNodes, key) {
+			con := heap.Pop(cHeap).(Contact)
+			go k.doFind(con, key, findValue, verify, respChannel)
+			queryCount++
+		}
+		responses := []iterativeResult{}
+		for idx := 0; idx < queryCount; idx++ {
+			resp := <-respChannel
+			responses = append(responses, resp)
+			if resp.success {
+				activeNodes = append(activeNodes, resp.target)
+				if findValue && resp.found() {
+					ret.target = resp.target
+					ret.value = resp.value
+					ret.values = resp.values
+					ret.total = resp.total
+					ret.record = resp.record
+				} else {
+					addContacts(resp.activeContactList)
 				}
+			} else if resp.rejected {
+				addContacts(resp.activeContactList)
 			}
 		}
+		if trace != nil {
+			trace.addRound(true, responses, cHeap)
+		}
+	}
+	if trace != nil {
+		if ret.found() {
+			trace.Termination = TerminatedValue
+		} else {
+			trace.Termination = termination
+		}
 	}
-	if findValue && ret.value != nil {
+	if findValue && ret.found() {
 		ret.activeContactList = nil
 	} else {
 		cHeap = &ContactHeap{activeNodes, key}
@@ -642,58 +950,190 @@ func (k *Kademlia) DoIterativeFindNode(id ID) (string, []Contact) {
 	// For project 2!
 	//return "ERR: Not implemented"
 	var buffer bytes.Buffer
-	resp := k.internalIterative(id, false)
+	resp := k.internalIterative(id, false, false, nil)
 	for idx, con := range resp.activeContactList {
-		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + con.NodeID.AsString() + " => " + con.Host.String() + ":" + strconv.Itoa(int(con.Port)))
+		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + con.NodeID.AsString() + " => " + JoinHostPort(con.Host, con.Port))
 	}
 	return buffer.String(), resp.activeContactList
 }
 func (k *Kademlia) DoIterativeStore(key ID, value []byte) (string, []Contact) {
 	// For project 2!
 	//return "ERR: Not implemented"
-	var buffer bytes.Buffer
-	resp := k.internalIterative(key, false)
-	for idx, con := range resp.activeContactList {
-		k.DoStore(&con, key, value)
-		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + con.NodeID.AsString() + " => " + con.Host.String() + ":" + strconv.Itoa(int(con.Port)))
+	report := k.IterativeStore(key, value)
+	if !report.QuorumMet() {
+		return report.String(), nil
 	}
-	return buffer.String(), resp.activeContactList
+	return report.String(), report.Accepted
 }
 func (k *Kademlia) DoIterativeFindValue(key ID) (string, []byte, []Contact) {
 	// For project 2!
 	//return "ERR: Not implemented"
-	resp := k.internalIterative(key, true)
+	resp := k.internalIterative(key, true, false, nil)
+	if resp.record != nil {
+		// the first record found may well be stale
+		latest, from := k.findLatestRecord(key)
+		if latest == nil || latest.Seq < resp.record.Seq {
+			latest, from = resp.record, resp.target
+		}
+		return from.NodeID.AsString() + " => " + string(latest.Value) + " (seq " +
+			strconv.FormatUint(latest.Seq, 10) + ")", latest.Value, nil
+	}
+	if resp.value != nil && k.ReadQuorum > 1 {
+		return k.DoQuorumFindValue(key, k.ReadQuorum)
+	}
 	if resp.value != nil {
 		return resp.target.NodeID.AsString() + " => " + string(resp.value), resp.value, nil
 	}
+	if resp.total > 0 {
+		values := k.fetchValues(resp.target, key, resp.values, resp.total)
+		return resp.target.NodeID.AsString() + " =>" + string(formatValues(values)), nil, nil
+	}
 	return "ERR", resp.value, resp.activeContactList
 }
 
-func (k *Kademlia) DoVanish(vdoID ID, data []byte, numberKeys byte, threshold byte, timeout int64) string {
-	vdo, err := VanishData(k, data, numberKeys, threshold, timeout)
-	resStr := "Failed: "
-	if err == nil {
-		k.vdoStorage.Put(vdoID, vdo)
-		resStr = "OK"
-	} else {
-		resStr += err.Error()
+// Store value on the k closest nodes to its ContentID, which only accept it
+// if it hashes to the key.
+func (k *Kademlia) DoIterativeStoreContent(value []byte) (string, ID, []Contact) {
+	key := ContentID(value)
+	report := k.storeOnClosest(key, func(con *Contact) error {
+		return k.internalStore(con, key, value, 0, 0, true)
+	})
+	if !report.QuorumMet() {
+		return report.String(), key, nil
+	}
+	return "OK: " + key.AsString() + strings.TrimPrefix(report.String(), "OK:"), key, report.Accepted
+}
+
+// Same as DoIterativeFindValue for a content-addressed key: values that do not
+// hash to key are discarded.
+func (k *Kademlia) DoIterativeFindContent(key ID) (string, []byte, []Contact) {
+	resp := k.internalIterative(key, true, true, nil)
+	if resp.value != nil {
+		return resp.target.NodeID.AsString() + " => " + string(resp.value), resp.value, nil
+	}
+	return "ERR", nil, resp.activeContactList
+}
+
+// Fetch the pages of the values of key held by target following the first
+// one. Stops early if target fails or its set shrank meanwhile.
+func (k *Kademlia) fetchValues(target Contact, key ID, first [][]byte, total int) [][]byte {
+	values := append([][]byte{}, first...)
+	for len(first) > 0 && len(values) < total {
+		res, ok := k.internalFindValue(&target, key, len(values))
+		if !ok || len(res.Values) == 0 {
+			break
+		}
+		values = append(values, res.Values...)
+		first = res.Values
+	}
+	return values
+}
+
+func formatValues(values [][]byte) []byte {
+	var buffer bytes.Buffer
+	for idx, val := range values {
+		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] " + string(val))
+	}
+	return buffer.Bytes()
+}
+
+// Look up all the values appended to key. Publishers may not have seen the
+// same k closest nodes, so the sets held by all of them are merged.
+func (k *Kademlia) DoIterativeFindValues(key ID) (string, [][]byte) {
+	resp := k.internalIterative(key, false, false, nil)
+	values := [][]byte{}
+	seen := make(map[string]bool)
+	for _, con := range resp.activeContactList {
+		res, ok := k.internalFindValue(&con, key, 0)
+		if !ok {
+			continue
+		}
+		page := res.Values
+		if res.Value != nil {
+			page = [][]byte{res.Value}
+		} else if res.Total > 0 {
+			page = k.fetchValues(con, key, res.Values, res.Total)
+		}
+		for _, val := range page {
+			if !seen[string(val)] {
+				seen[string(val)] = true
+				values = append(values, val)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return "ERR", nil
+	}
+	return "OK: " + strconv.Itoa(len(values)) + " values" + string(formatValues(values)), values
+}
+
+func (k *Kademlia) internalAppend(contact *Contact, key ID, value []byte, ttl time.Duration) error {
+	client := k.dialContact(contact)
+	if client == nil {
+		return errors.New("Failed to connect to " + contact.NodeID.AsString())
+	}
+	defer client.Close()
+	req := AppendRequest{k.selfContact(), NewRandomID(), key, value, ttl}
+	var res AppendResult
+	err := k.call(client, contact.NodeID.AsString(), "KademliaCore.Append", req, &res)
+	if _, refused := err.(rpc.ServerError); err != nil && !refused {
+		k.contactFailed(contact.NodeID)
+	}
+	if err == nil && !res.MsgID.Equals(req.MsgID) {
+		err = errors.New("Mismatched message ID")
+	}
+	return err
+}
+
+// Add value to the set of values of key on the k closest nodes, where it
+// lives for ttl unless appended again.
+func (k *Kademlia) DoIterativeAppend(key ID, value []byte, ttl time.Duration) (string, []Contact) {
+	report := k.storeOnClosest(key, func(con *Contact) error {
+		return k.internalAppend(con, key, value, ttl)
+	})
+	if !report.QuorumMet() {
+		return report.String(), nil
+	}
+	return report.String(), report.Accepted
+}
+
+// Vanish data and keep the VDO under vdoID, rescheduling its shares until it
+// expires after lifetime. The report tells which shares were stored where, and
+// comes with an error when the VDO could not be created, in which case it is
+// not kept.
+func (k *Kademlia) Vanish(vdoID ID, data []byte, numberKeys byte, threshold byte,
+	lifetime time.Duration) (*VanishReport, error) {
+	report, err := VanishData(k, data, numberKeys, threshold, lifetime)
+	if err != nil {
+		k.log.Warn("vanish failed", "vdo_id", vdoID.AsString(), "stored", report.Stored,
+			"attempted", report.Attempted(), "err", err)
+		return &report, err
 	}
-	return "OK"
+	k.vdoStorage.Put(vdoID, report.VDO)
+	k.vdos.Schedule(vdoID, report.VDO)
+	return &report, nil
 }
 
-func (k *Kademlia) getVDO(contact *Contact, vdoID ID) (res GetVDOResult, ok bool) {
-	client := GetClient(contact.Host, contact.Port)
+// The VDO contact holds under vdoID, res.Err telling why it has none. ok is
+// false when contact could not be asked.
+func (k *Kademlia) FetchVDO(contact *Contact, vdoID ID) (res GetVDOResult, ok bool) {
+	client := k.dialContact(contact)
 	if client == nil {
 		ok = false
 		return
 	}
 	defer client.Close()
 	req := new(GetVDORequest)
-	req.Sender = k.SelfContact
+	req.Sender = k.selfContact()
 	req.MsgID = NewRandomID()
 	req.VdoID = vdoID
-	err := client.Call("KademliaCore.GetVDO", req, &res)
+	err := k.call(client, contact.NodeID.AsString(), "KademliaCore.GetVDO", req, &res)
+	if msg, refused := err.(rpc.ServerError); refused {
+		res.Err = errors.New(string(msg))
+		return res, true
+	}
 	if err != nil || !req.MsgID.Equals(res.MsgID) {
+		k.contactFailed(contact.NodeID)
 		ok = false
 		return
 	}
@@ -702,17 +1142,106 @@ func (k *Kademlia) getVDO(contact *Contact, vdoID ID) (res GetVDOResult, ok bool
 }
 
 func (k *Kademlia) DoUnvanish(contact *Contact, vdoID ID) string {
-	resStr := "Failed"
-	vdoRes, ok := k.getVDO(contact, vdoID)
+	vdoRes, ok := k.FetchVDO(contact, vdoID)
 	if !ok {
 		return "Failed to GetVDO"
 	}
 	if vdoRes.Err != nil {
 		return "Failed: " + vdoRes.Err.Error()
 	}
-	data, _ := UnvanishData(k, vdoRes.VDO, true)
-	if data != nil {
-		resStr = "OK, data =>\n" + string(data)
+	return k.unvanish(vdoRes.VDO)
+}
+
+// Recover the data of vdo. The error wraps ErrVDOExpired, ErrVDODecrypt,
+// ErrNotEnoughShares or ErrVDOFormat when one of them is why it failed.
+func (k *Kademlia) Unvanish(vdo VanishingDataObject) ([]byte, error) {
+	data, _, err := UnvanishData(k, vdo, true)
+	return data, err
+}
+
+func (k *Kademlia) unvanish(vdo VanishingDataObject) string {
+	data, err := k.Unvanish(vdo)
+	if err != nil {
+		return "Failed: " + err.Error()
+	}
+	return "OK, data =>\n" + string(data)
+}
+
+func (k *Kademlia) LocalVDO(vdoID ID) (VanishingDataObject, bool) {
+	ival, ok := k.vdoStorage.Get(vdoID)
+	if !ok {
+		return VanishingDataObject{}, false
+	}
+	return ival.(VanishingDataObject), true
+}
+
+// Unvanish a VDO held by this node, without a GetVDO round trip.
+func (k *Kademlia) DoUnvanishLocal(vdoID ID) string {
+	vdo, ok := k.LocalVDO(vdoID)
+	if !ok {
+		return "ERR: No VDO stored under " + vdoID.AsString()
+	}
+	return k.unvanish(vdo)
+}
+
+// Resume the VDO re-pushes saved in path, and save them there from now on.
+func (k *Kademlia) LoadVDOSchedule(path string) error {
+	return k.vdos.Load(path)
+}
+
+func (k *Kademlia) ScheduledVDOs() []ScheduledVDO {
+	return k.vdos.List()
+}
+
+func (k *Kademlia) DoVDOList() string {
+	var buffer bytes.Buffer
+	scheduled := k.vdos.List()
+	buffer.WriteString("OK: " + strconv.Itoa(len(scheduled)) + " VDOs scheduled")
+	for _, s := range scheduled {
+		buffer.WriteString("\n" + s.VdoID.AsString() + " expires " + s.VDO.ExpiresAt().Format(time.RFC3339) +
+			", next push " + s.NextPush.Format(time.RFC3339))
+		if !s.LastPush.IsZero() {
+			buffer.WriteString(", last push " + s.LastPush.Format(time.RFC3339))
+		}
+		if s.Failures > 0 {
+			buffer.WriteString(", " + strconv.Itoa(s.Failures) + " failed pushes: " + s.LastErr)
+		}
+	}
+	return buffer.String()
+}
+
+func (k *Kademlia) DoVDOCancel(vdoID ID) string {
+	if !k.vdos.Cancel(vdoID) {
+		return "ERR: No VDO scheduled under " + vdoID.AsString()
+	}
+	return "OK: " + vdoID.AsString() + " will not be pushed again"
+}
+
+func (k *Kademlia) DoVDOExtend(vdoID ID, by time.Duration) string {
+	vdo, err := k.vdos.Extend(vdoID, by)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: " + vdoID.AsString() + " expires " + vdo.ExpiresAt().Format(time.RFC3339)
+}
+
+// Encode the VDO this node stored under vdoID, armored if asked to.
+func (k *Kademlia) DoVanishExport(vdoID ID, armored bool) (string, []byte) {
+	vdo, ok := k.LocalVDO(vdoID)
+	if !ok {
+		return "ERR: No VDO stored under " + vdoID.AsString(), nil
+	}
+	if armored {
+		return "OK", ArmorVDO(vdo)
+	}
+	return "OK", EncodeVDO(vdo)
+}
+
+// Unvanish a VDO given in either of its encoded forms.
+func (k *Kademlia) DoUnvanishImport(encoded []byte) string {
+	vdo, err := ParseVDO(encoded)
+	if err != nil {
+		return "ERR: " + err.Error()
 	}
-	return resStr
+	return k.unvanish(vdo)
 }
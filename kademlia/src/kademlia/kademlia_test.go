@@ -3,8 +3,19 @@ package kademlia
 import (
 	"bytes"
 	"container/heap"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sss"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,6 +27,17 @@ const divNum = 3
 
 type KademliaList []*Kademlia
 
+// the tests start hundreds of nodes, only errors are worth seeing
+var testLogger = NewLogger(os.Stderr, slog.LevelError)
+
+func newTestKademlia(laddr string, nodeId *ID) *Kademlia {
+	k, err := NewKademliaWithLogger(laddr, nodeId, testLogger)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
 func GenerateRandomIDList(num int) (ret []ID) {
 	ret = make([]ID, num)
 	for i := 0; i < num; i++ {
@@ -47,9 +69,9 @@ func GenerateTestList(num int, idList []ID) (kRet KademliaList, cRet []Contact)
 		testPort++
 		var k *Kademlia
 		if idList != nil && i < len(idList) {
-			k = NewKademlia(laddr, &idList[i])
+			k = newTestKademlia(laddr, &idList[i])
 		} else {
-			k = NewKademlia(laddr, nil)
+			k = newTestKademlia(laddr, nil)
 		}
 		cRet = append(cRet, k.SelfContact)
 		kRet = append(kRet, k)
@@ -72,23 +94,7 @@ func SortContact(input []Contact, key ID) (ret []Contact) {
 }
 
 func StringToIpPort(laddr string) (ip net.IP, port uint16, err error) {
-	hostString, portString, err := net.SplitHostPort(laddr)
-	if err != nil {
-		return
-	}
-	ipStr, err := net.LookupHost(hostString)
-	if err != nil {
-		return
-	}
-	for i := 0; i < len(ipStr); i++ {
-		ip = net.ParseIP(ipStr[i])
-		if ip.To4() != nil {
-			break
-		}
-	}
-	portInt, err := strconv.Atoi(portString)
-	port = uint16(portInt)
-	return
+	return ParseHostPort(laddr)
 }
 
 func CompareContactList(l1, l2 []Contact) string {
@@ -119,8 +125,8 @@ func TestPing(t *testing.T) {
 	testPort++
 	lport2 := testPort
 	testPort++
-	instance1 := NewKademlia("localhost:"+strconv.Itoa(int(lport1)), nil)
-	instance2 := NewKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
+	instance1 := newTestKademlia("localhost:"+strconv.Itoa(int(lport1)), nil)
+	instance2 := newTestKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
 	host2, port2, _ := StringToIpPort("localhost:" + strconv.Itoa(int(lport2)))
 	instance1.DoPing(host2, port2)
 	time.Sleep(30 * time.Millisecond)
@@ -149,8 +155,8 @@ func TestStore(t *testing.T) {
 	testPort++
 	lport2 := testPort
 	testPort++
-	instance1 := NewKademlia("localhost:"+strconv.Itoa(int(lport1)), nil)
-	instance2 := NewKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
+	instance1 := newTestKademlia("localhost:"+strconv.Itoa(int(lport1)), nil)
+	instance2 := newTestKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
 	host2, port2, _ := StringToIpPort("localhost:" + strconv.Itoa(int(lport2)))
 	instance1.DoPing(host2, port2)
 	time.Sleep(30 * time.Millisecond)
@@ -352,6 +358,43 @@ func TestIterativeFindNode(t *testing.T) {
 	return
 }
 
+// On the sparse tree network, most nodes are only learned of from the nodes
+// queried last in the lookup.
+func TestIterativeFindNodeClosest(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, cList := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		key := NewRandomID()
+		searcher := kList[i%kNum]
+		_, res := searcher.DoIterativeFindNode(key)
+		others := []Contact{}
+		for _, con := range cList {
+			if !con.NodeID.Equals(searcher.NodeID) {
+				others = append(others, con)
+			}
+		}
+		// there are fewer than K of them, so all should be found
+		expected := SortContact(others, key)
+		if len(res) != len(expected) {
+			t.Error("The lookup found " + strconv.Itoa(len(res)) + " of the " + strconv.Itoa(len(expected)) + " other nodes")
+			return
+		}
+		for idx := range expected {
+			if !res[idx].NodeID.Equals(expected[idx].NodeID) {
+				t.Error("The lookup should return the closest nodes first")
+				return
+			}
+		}
+	}
+	t.Log("TestIterativeFindNodeClosest done successfully!\n")
+	return
+}
+
 func TestIterativeFindValue(t *testing.T) {
 	kNum := 120
 	targetIdx := kNum - 23
@@ -387,6 +430,73 @@ func TestIterativeFindValue(t *testing.T) {
 	return
 }
 
+func TestIterativeFindValueClosest(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 40; i++ {
+		key := NewRandomID()
+		holder := kList[0]
+		for _, k := range kList[1:] {
+			if k.NodeID.Xor(key).Less(holder.NodeID.Xor(key)) {
+				holder = k
+			}
+		}
+		searcher := kList[i%kNum]
+		if searcher == holder {
+			continue
+		}
+		holder.storage.Put(key, StoredValue{Value: []byte("value")})
+		resp := searcher.internalIterative(key, true, false, nil)
+		if string(resp.value) != "value" {
+			t.Error("The lookup should find the value on the node closest to the key")
+			return
+		}
+	}
+	t.Log("TestIterativeFindValueClosest done successfully!\n")
+	return
+}
+
+// The contacts of a star's centre know no one else, so a value on the fourth
+// closest of them is only found in the last round of the lookup.
+func TestIterativeFindValueLastRound(t *testing.T) {
+	kNum := 6
+	kList, cList := GenerateTestList(kNum, nil)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, 0)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		key := NewRandomID()
+		holder := SortContact(cList[1:], key)[alpha]
+		for _, k := range kList[1:] {
+			if k.NodeID.Equals(holder.NodeID) {
+				k.storage.Put(key, StoredValue{Value: []byte("value")})
+			}
+		}
+		resp := kList[0].internalIterative(key, true, false, nil)
+		if string(resp.value) != "value" {
+			t.Error("The lookup should find the value in its last round")
+			return
+		}
+		if !resp.target.NodeID.Equals(holder.NodeID) {
+			t.Error("The lookup should report the node that returned the value")
+			return
+		}
+		trace := kList[0].TraceLookup(key, true)
+		if trace.Termination != TerminatedValue || !trace.ValueFrom.NodeID.Equals(holder.NodeID) {
+			t.Error("The trace should end with the value found, got " + trace.Termination)
+			return
+		}
+	}
+	t.Log("TestIterativeFindValueLastRound done successfully!\n")
+	return
+}
+
 func TestIterativeStore(t *testing.T) {
 	kNum := 120
 	targetIdx := kNum - 23
@@ -414,3 +524,1270 @@ func TestIterativeStore(t *testing.T) {
 	t.Log("TestIterativeStore done successfully!\n")
 	return
 }
+
+func TestObservedAddress(t *testing.T) {
+	lport1 := testPort
+	testPort++
+	lport2 := testPort
+	testPort++
+	instance1 := newTestKademlia("0.0.0.0:"+strconv.Itoa(int(lport1)), nil)
+	instance2 := newTestKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
+	if usableHost(instance1.selfContact().Host) {
+		t.Error("Instance 1 should not know its address before pinging anyone")
+		return
+	}
+	host2, port2, _ := StringToIpPort("localhost:" + strconv.Itoa(int(lport2)))
+	instance1.DoPing(host2, port2)
+	time.Sleep(30 * time.Millisecond)
+	self1 := instance1.selfContact()
+	if !self1.Host.Equal(host2) {
+		t.Error("Instance 1 should have learned its address from the pong: " + self1.Host.String())
+	}
+	contact1, err := instance2.FindContact(instance1.NodeID)
+	if err != nil {
+		t.Error("Instance 1's contact not found in Instance 2's contact list")
+		return
+	}
+	if !contact1.Host.Equal(host2) {
+		t.Error("Instance 2 should have recorded the observed address of Instance 1: " + contact1.Host.String())
+	}
+	t.Log("TestObservedAddress done successfully!\n")
+	return
+}
+
+// A pong reports the address the ping came from, never the one its sender
+// claims, even in another address family.
+func TestObservedAddressFamily(t *testing.T) {
+	lport := testPort
+	testPort++
+	instance := newTestKademlia("localhost:"+strconv.Itoa(int(lport)), nil)
+	observed := net.ParseIP("127.0.0.1")
+	server, conn := net.Pipe()
+	go instance.server.ServeCodec(newObservingServerCodec(server, observed, instance))
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	sender := Contact{NodeID: NewRandomID(), Host: net.ParseIP("::1"), Port: 3000}
+	var pong PongMessage
+	if err := client.Call("KademliaCore.Ping", PingMessage{Sender: sender, MsgID: NewRandomID()}, &pong); err != nil {
+		t.Error("Ping failed: " + err.Error())
+		return
+	}
+	if !pong.Observed.Equal(observed) {
+		t.Error("The pong should report the address the ping came from: " + pong.Observed.String())
+	}
+	time.Sleep(30 * time.Millisecond)
+	contact, err := instance.FindContact(sender.NodeID)
+	if err != nil {
+		t.Error("The sender should have been added to the contacts")
+		return
+	}
+	if !contact.Host.Equal(sender.Host) || contact.hostFor(observed) == nil || !contact.hostFor(observed).Equal(observed) {
+		t.Error("The observed address should be kept along with the claimed one")
+	}
+	t.Log("TestObservedAddressFamily done successfully!\n")
+	return
+}
+
+func TestIPv6Contact(t *testing.T) {
+	lport1 := testPort
+	testPort++
+	lport2 := testPort
+	testPort++
+	instance1 := newTestKademlia("[::1]:"+strconv.Itoa(int(lport1)), nil)
+	instance2 := newTestKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
+	host2, port2, _ := StringToIpPort("localhost:" + strconv.Itoa(int(lport2)))
+	instance1.DoPing(host2, port2)
+	time.Sleep(30 * time.Millisecond)
+	contact1, err := instance2.FindContact(instance1.NodeID)
+	if err != nil {
+		t.Error("Instance 1's contact not found in Instance 2's contact list")
+		return
+	}
+	if !contact1.Host.Equal(net.ParseIP("::1")) {
+		t.Error("Instance 1 only listens on IPv6 and should be stored as such: " + contact1.Host.String())
+		return
+	}
+	randID := NewRandomID()
+	randVal := NewRandomID().AsString()
+	instance2.DoStore(contact1, randID, []byte(randVal))
+	_, val := instance1.LocalFindValue(randID)
+	if string(val) != randVal {
+		t.Error("Instance 1 should have the value stored over IPv6")
+		return
+	}
+	t.Log("TestIPv6Contact done successfully!\n")
+	return
+}
+
+func TestMergeContact(t *testing.T) {
+	id := NewRandomID()
+	v4 := Contact{NodeID: id, Host: net.ParseIP("127.0.0.1"), Port: 3000}
+	v6 := Contact{NodeID: id, Host: net.ParseIP("::1"), Port: 3000}
+	merged := mergeContact(v4, v6)
+	if !merged.Host.Equal(v6.Host) {
+		t.Error("The newest address should be the primary one: " + merged.Host.String())
+	}
+	if len(merged.AltHosts) != 1 || !merged.AltHosts[0].Equal(v4.Host) {
+		t.Error("The IPv4 address should have been kept as an alternative")
+	}
+	moved := Contact{NodeID: id, Host: net.ParseIP("10.0.0.1"), Port: 3000}
+	merged = mergeContact(merged, moved)
+	if len(merged.Addresses()) != 2 || merged.hostFor(v4.Host).Equal(v4.Host) {
+		t.Error("A new IPv4 address should replace the old one")
+	}
+	t.Log("TestMergeContact done successfully!\n")
+	return
+}
+
+func TestRelay(t *testing.T) {
+	kNum := 3
+	kList, cList := GenerateTestList(kNum, nil)
+	relay, relayed, client := kList[0], kList[1], kList[2]
+	kList.ConnectTo(1, 0)
+	kList.ConnectTo(2, 0)
+	time.Sleep(30 * time.Millisecond)
+	reachable, _, err := relayed.CheckReachability()
+	if err != nil || !reachable {
+		t.Error("A node on localhost should be reachable")
+		return
+	}
+	if err := relayed.RegisterRelay(&cList[0]); err != nil {
+		t.Error("Failed to register with the relay: " + err.Error())
+		return
+	}
+	time.Sleep(30 * time.Millisecond)
+	// nobody else can take over the registration
+	relayAddr := JoinHostPort(cList[0].Host, cList[0].Port)
+	if conn, err := dialConnect(relayAddr, relayControlPath+relayed.NodeID.AsString()); err == nil {
+		conn.Close()
+		t.Error("A live registration should not be replaced")
+	}
+	// nor register for a node ID it does not answer as
+	impostorID := NewRandomID()
+	if conn, err := dialConnect(relayAddr, relayControlPath+impostorID.AsString()); err == nil {
+		go client.server.ServeCodec(newObservingServerCodec(conn, nil, client))
+	}
+	time.Sleep(30 * time.Millisecond)
+	relay.relayLock.Lock()
+	_, impostorRelayed := relay.relayed[impostorID.AsString()]
+	relay.relayLock.Unlock()
+	if impostorRelayed {
+		t.Error("A node answering as another node ID should not be relayed")
+	}
+	// pretend the relayed node is behind a NAT: its own address goes nowhere
+	behindNAT := relayed.selfContact()
+	behindNAT.Host = net.ParseIP("127.0.0.2")
+	if len(behindNAT.Relays) != 1 || !behindNAT.Relays[0].NodeID.Equals(relay.NodeID) {
+		t.Error("The relayed node should advertise its relay")
+		return
+	}
+	randID := NewRandomID()
+	randVal := NewRandomID().AsString()
+	res := client.DoStore(&behindNAT, randID, []byte(randVal))
+	if res != "OK: "+relayed.NodeID.AsString() {
+		t.Error("Store through the relay failed: " + res)
+		return
+	}
+	_, val := relayed.LocalFindValue(randID)
+	if string(val) != randVal {
+		t.Error("The relayed node should have the value stored through the relay")
+		return
+	}
+	t.Log("TestRelay done successfully!\n")
+	return
+}
+
+func TestDialBackLimiter(t *testing.T) {
+	var l dialBackLimiter
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < dialBacksPerWindow; i++ {
+		if !l.allow(ip, now) {
+			t.Error("The first checks of an address should be allowed")
+			return
+		}
+	}
+	if l.allow(ip, now) {
+		t.Error("Too many checks of an address should be refused")
+	}
+	if !l.allow(net.ParseIP("192.0.2.2"), now) {
+		t.Error("Other addresses should not be limited")
+	}
+	if !l.allow(ip, now.Add(dialBackWindow)) {
+		t.Error("The limit should be reset after the window")
+	}
+	t.Log("TestDialBackLimiter done successfully!\n")
+	return
+}
+
+func TestMetrics(t *testing.T) {
+	lport1 := testPort
+	testPort++
+	lport2 := testPort
+	testPort++
+	instance1 := newTestKademlia("localhost:"+strconv.Itoa(int(lport1)), nil)
+	instance2 := newTestKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
+	host2, port2, _ := StringToIpPort("localhost:" + strconv.Itoa(int(lport2)))
+	instance1.DoPing(host2, port2)
+	contact2 := instance2.selfContact()
+	instance1.DoStore(&contact2, NewRandomID(), []byte("value"))
+	time.Sleep(30 * time.Millisecond)
+
+	resp, err := http.Get("http://" + JoinHostPort(host2, port2) + MetricsPath)
+	if err != nil {
+		t.Error("Failed to get the metrics: " + err.Error())
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		`kademlia_rpcs_received_total{rpc="Ping"} 1`,
+		`kademlia_rpcs_received_total{rpc="Store"} 1`,
+		`kademlia_stored_keys 1`,
+		`kademlia_stored_bytes 5`,
+		"kademlia_routing_table_contacts{bucket=\"" + strconv.Itoa(instance1.NodeID.Xor(instance2.NodeID).PrefixLen()) + "\"} 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Error("Metrics of instance 2 should contain: " + line)
+		}
+	}
+	t.Log("TestMetrics done successfully!\n")
+	return
+}
+
+func TestListenError(t *testing.T) {
+	lport := testPort
+	testPort++
+	laddr := "localhost:" + strconv.Itoa(int(lport))
+	_ = newTestKademlia(laddr, nil)
+	k, err := NewKademliaWithLogger(laddr, nil, testLogger)
+	if err == nil || k != nil {
+		t.Error("Listening on a port already in use should fail")
+		return
+	}
+	t.Log("TestListenError done successfully!\n")
+	return
+}
+
+func TestTraceLookup(t *testing.T) {
+	kNum := 30
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	targetIdx := kNum - 2
+	searchKey := kList[targetIdx].SelfContact.NodeID
+	randValue := []byte(NewRandomID().AsString())
+	kList[0].DoStore(&kList[targetIdx].SelfContact, searchKey, randValue)
+	trace := kList[0].TraceLookup(searchKey, true)
+	if string(trace.Value) != string(randValue) {
+		t.Error("The traced lookup should find the value")
+		return
+	}
+	if trace.Termination != TerminatedValue {
+		t.Error("The lookup should have terminated because of the value: " + trace.Termination)
+	}
+	if !trace.ValueFrom.NodeID.Equals(kList[targetIdx].NodeID) {
+		t.Error("The value should come from the target node: " + trace.ValueFrom.NodeID.AsString())
+	}
+	found := false
+	for _, round := range trace.Rounds {
+		for _, q := range round.Queries {
+			if q.FoundValue && q.Contact.NodeID.Equals(kList[targetIdx].NodeID) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Error("The query returning the value should be in the trace:\n" + trace.String())
+	}
+	t.Log("TestTraceLookup done successfully!\n")
+	return
+}
+
+func TestRoutingTableSnapshot(t *testing.T) {
+	lport1 := testPort
+	testPort++
+	lport2 := testPort
+	testPort++
+	instance1 := newTestKademlia("localhost:"+strconv.Itoa(int(lport1)), nil)
+	instance2 := newTestKademlia("localhost:"+strconv.Itoa(int(lport2)), nil)
+	host2, port2, _ := StringToIpPort("localhost:" + strconv.Itoa(int(lport2)))
+	instance1.DoPing(host2, port2)
+	time.Sleep(30 * time.Millisecond)
+	find := func() *ContactSnapshot {
+		for _, b := range instance1.RoutingTableSnapshot() {
+			if b.Index != instance1.NodeID.Xor(instance2.NodeID).PrefixLen() {
+				t.Error("Instance 2 listed in the wrong bucket")
+			}
+			for _, c := range b.Contacts {
+				if c.Contact.NodeID.Equals(instance2.NodeID) {
+					return &c
+				}
+			}
+		}
+		return nil
+	}
+	c := find()
+	if c == nil {
+		t.Error("Instance 2 not found in Instance 1's routing table snapshot")
+		return
+	}
+	if c.LastSeen.IsZero() || c.Failures != 0 {
+		t.Error("Instance 2 should have been seen without failures")
+	}
+	instance2.Close()
+	contact2 := c.Contact
+	instance1.DoFindNode(&contact2, instance2.NodeID)
+	time.Sleep(30 * time.Millisecond)
+	c = find()
+	if c == nil || c.Failures != 1 {
+		t.Error("The failed FIND_NODE should be counted against Instance 2")
+		return
+	}
+	t.Log("TestRoutingTableSnapshot done successfully!\n")
+	return
+}
+
+func TestIterativeAppend(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	key := NewRandomID()
+	want := map[string]bool{}
+	// more values than fit in one FIND_VALUE page, from several publishers
+	for i := 0; i < 2*valuesPerPage; i++ {
+		value := "value" + strconv.Itoa(i)
+		want[value] = true
+		res, _ := kList[i%4].DoIterativeAppend(key, []byte(value), time.Minute)
+		if !strings.HasPrefix(res, "OK") {
+			t.Error("Append failed: " + res)
+			return
+		}
+	}
+	// appending again only refreshes the value
+	kList[0].DoIterativeAppend(key, []byte("value0"), time.Minute)
+	_, values := kList[kNum-1].DoIterativeFindValues(key)
+	if len(values) != len(want) {
+		t.Error("Expected " + strconv.Itoa(len(want)) + " values, got " + strconv.Itoa(len(values)))
+		return
+	}
+	for _, val := range values {
+		if !want[string(val)] {
+			t.Error("Unexpected value " + string(val))
+		}
+	}
+
+	vs := NewValueSetStorage()
+	publisher := NewRandomID()
+	vs.Append(key, publisher, []byte("short"), 10*time.Millisecond)
+	vs.Append(key, publisher, []byte("long"), time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	page, total := vs.GetPage(key, 0, valuesPerPage)
+	if total != 1 || string(page[0]) != "long" {
+		t.Error("The expired value should be gone")
+	}
+	t.Log("TestIterativeAppend done successfully!\n")
+	return
+}
+
+func TestBlob(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	data := make([]byte, 3*ChunkSize+100)
+	rand.Read(data)
+	key, err := kList[0].PutBlob(data)
+	if err != nil {
+		t.Error("PutBlob failed: " + err.Error())
+		return
+	}
+	got, err := kList[kNum-1].GetBlob(key)
+	if err != nil {
+		t.Error("GetBlob failed: " + err.Error())
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("The blob read back differs from the one stored")
+	}
+	m, err := DecodeManifest((&Manifest{Size: 10, Chunks: []ChunkRef{{NewRandomID(), 10}}}).Encode())
+	if err != nil || m.Size != 10 || len(m.Chunks) != 1 {
+		t.Error("The manifest should decode to what was encoded")
+	}
+	if _, err := DecodeManifest([]byte(manifestHeader + "\nsize 11\nchunk " + key.AsString() + " 10\n")); err == nil {
+		t.Error("A manifest whose chunks do not add up should be rejected")
+	}
+	t.Log("TestBlob done successfully!\n")
+	return
+}
+
+func TestContentAddressed(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	value := []byte(NewRandomID().AsString())
+	_, key, stored := kList[0].DoIterativeStoreContent(value)
+	if !key.Equals(ContentID(value)) || len(stored) == 0 {
+		t.Error("The value should be stored under its content ID")
+		return
+	}
+	if kList[0].internalStore(&stored[0], NewRandomID(), value, 0, 0, true) == nil {
+		t.Error("A value not matching its content key should be rejected")
+	}
+	// nobody can replace the value with other content, whatever its version
+	future := time.Now().Add(maxVersionSkew / 2).UnixNano()
+	for _, con := range stored {
+		if kList[0].internalStore(&con, key, []byte("garbage"), future, 0, false) == nil {
+			t.Error("A value stored under its content key should not be replaced")
+			return
+		}
+	}
+	// but half the nodes holding it were sent garbage before it
+	liars := map[string]bool{}
+	for i, con := range stored {
+		if i%2 == 0 {
+			liars[con.NodeID.AsString()] = true
+		}
+	}
+	for _, k := range kList {
+		if liars[k.NodeID.AsString()] {
+			k.storage.Put(key, StoredValue{Value: []byte("garbage"), Version: future})
+		}
+	}
+	searcher := kList[kNum-1]
+	_, found, _ := searcher.DoIterativeFindContent(key)
+	if !bytes.Equal(found, value) {
+		t.Error("The lookup should skip the garbage and find the value")
+		return
+	}
+	var liar *Kademlia
+	for _, k := range kList {
+		if liars[k.NodeID.AsString()] && k != searcher {
+			liar = k
+			break
+		}
+	}
+	liar.DoPing(searcher.SelfContact.Host, searcher.SelfContact.Port)
+	time.Sleep(30 * time.Millisecond)
+	respCh := make(chan iterativeResult, 1)
+	searcher.doFind(liar.SelfContact, key, true, true, respCh)
+	if resp := <-respCh; resp.success || resp.value != nil {
+		t.Error("The garbage returned by a peer should be discarded")
+	}
+	time.Sleep(30 * time.Millisecond)
+	// anyone could have stored it there
+	if searcher.findContactFromKRoutingTable(liar.NodeID) == nil {
+		t.Error("A peer returning garbage it may have been sent should not be evicted")
+	}
+	if kList[0].internalStore(&liar.SelfContact, key, value, time.Now().UnixNano(), 0, true) != nil {
+		t.Error("The content should replace a value not matching its key")
+	}
+	searcher.doFind(liar.SelfContact, key, true, true, respCh)
+	if resp := <-respCh; !bytes.Equal(resp.value, value) {
+		t.Error("The peer should return the content once it holds it")
+	}
+	t.Log("TestContentAddressed done successfully!\n")
+	return
+}
+
+func TestSignedRecord(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := RecordKey(priv.Public().(ed25519.PublicKey))
+	kList[0].DoIterativePutRecord(priv, []byte("first"))
+	res, r, stored := kList[1].DoIterativePutRecord(priv, []byte("second"))
+	if r == nil || r.Seq != 2 {
+		t.Error("The second record should get sequence number 2: " + res)
+		return
+	}
+	_, val, _ := kList[kNum-1].DoIterativeFindValue(key)
+	if string(val) != "second" {
+		t.Error("The latest record should be found, got " + string(val))
+	}
+	if kList[0].internalStoreRecord(&stored[0], key, NewSignedRecord(priv, 1, []byte("stale"))) == nil {
+		t.Error("A record with an old sequence number should be rejected")
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	forged := NewSignedRecord(other, 10, []byte("forged"))
+	forged.PublicKey = priv.Public().(ed25519.PublicKey)
+	if kList[0].internalStoreRecord(&stored[0], key, forged) == nil {
+		t.Error("A record with an invalid signature should be rejected")
+	}
+	if kList[0].internalStore(&stored[0], key, []byte("overwrite"), time.Now().UnixNano(), 0, false) == nil {
+		t.Error("A plain store over a record should be rejected")
+	}
+	// a peer can only hold a forged record if it skipped verifying it
+	searcher := kList[kNum-1]
+	var liar *Kademlia
+	for _, k := range kList {
+		for _, con := range stored {
+			if k.NodeID.Equals(con.NodeID) && k != searcher {
+				liar = k
+			}
+		}
+	}
+	liar.records.lock.Lock()
+	liar.records.storage[key.AsString()] = forged
+	liar.records.lock.Unlock()
+	liar.DoPing(searcher.SelfContact.Host, searcher.SelfContact.Port)
+	time.Sleep(30 * time.Millisecond)
+	respCh := make(chan iterativeResult, 1)
+	searcher.doFind(liar.SelfContact, key, true, false, respCh)
+	if resp := <-respCh; resp.success || resp.record != nil {
+		t.Error("A forged record returned by a peer should be discarded")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if searcher.findContactFromKRoutingTable(liar.NodeID) != nil {
+		t.Error("The peer returning a forged record should be evicted")
+	}
+	// and not come back when it gets in touch again
+	liar.DoPing(searcher.SelfContact.Host, searcher.SelfContact.Port)
+	time.Sleep(30 * time.Millisecond)
+	if searcher.findContactFromKRoutingTable(liar.NodeID) != nil {
+		t.Error("The peer returning a forged record should be kept out of the k-buckets")
+	}
+	for _, con := range searcher.getLastContactFromRoutingTable(key) {
+		if con.NodeID.Equals(liar.NodeID) {
+			t.Error("The peer returning a forged record should not be handed out")
+		}
+	}
+	t.Log("TestSignedRecord done successfully!\n")
+	return
+}
+
+func TestQuorumRead(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	key := NewRandomID()
+	_, stored := kList[0].DoIterativeStore(key, []byte("new"))
+	if len(stored) < 4 {
+		t.Error("The value should be stored on several nodes")
+		return
+	}
+	nodes := map[string]*Kademlia{}
+	for _, k := range kList {
+		nodes[k.NodeID.AsString()] = k
+	}
+	// the closest replicas missed the last write
+	stale := stored[:2]
+	for _, con := range stale {
+		nodes[con.NodeID.AsString()].storage.Put(key, StoredValue{Value: []byte("old"), Version: 1})
+	}
+	if kList[0].internalStore(&stale[0], key, []byte("older"), 0, 0, false) == nil {
+		t.Error("A value older than the stored one should be rejected")
+	}
+	// a node does not query itself, so it must not be one of the stale ones
+	reader := kList[kNum-1]
+	for _, k := range kList[1:] {
+		if !k.NodeID.Equals(stale[0].NodeID) && !k.NodeID.Equals(stale[1].NodeID) {
+			reader = k
+		}
+	}
+	_, val, _ := reader.DoQuorumFindValue(key, 3)
+	if string(val) != "new" {
+		t.Error("The quorum read should return the newest value, got " + string(val))
+		return
+	}
+	for _, con := range stale {
+		if _, v := nodes[con.NodeID.AsString()].LocalFindValue(key); string(v) != "new" {
+			t.Error("The stale replica should have been repaired")
+		}
+	}
+	t.Log("TestQuorumRead done successfully!\n")
+	return
+}
+
+func TestQuorumReadLyingReplica(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	key := NewRandomID()
+	_, stored := kList[0].DoIterativeStore(key, []byte("honest"))
+	if len(stored) < 4 {
+		t.Error("The value should be stored on several nodes")
+		return
+	}
+	nodes := map[string]*Kademlia{}
+	for _, k := range kList {
+		nodes[k.NodeID.AsString()] = k
+	}
+	// the closest replica claims a version no one can top
+	liar := nodes[stored[0].NodeID.AsString()]
+	liar.storage.Put(key, StoredValue{Value: []byte("garbage"), Version: math.MaxInt64})
+	reader := kList[kNum-1]
+	for _, k := range kList[1:] {
+		if !k.NodeID.Equals(liar.NodeID) {
+			reader = k
+		}
+	}
+	_, val, _ := reader.DoQuorumFindValue(key, 3)
+	if string(val) != "honest" {
+		t.Error("The value a quorum agrees on should win, got " + string(val))
+		return
+	}
+	for _, con := range stored[1:] {
+		if _, v := nodes[con.NodeID.AsString()].LocalFindValue(key); string(v) != "honest" {
+			t.Error("The lying replica should not be copied to the others")
+		}
+	}
+
+	// nor can a writer make a value impossible to replace
+	if kList[0].internalStore(&stored[1], key, []byte("garbage"), math.MaxInt64, 0, false) == nil {
+		t.Error("A version from the future should be refused")
+	}
+	if report := kList[0].IterativeStore(key, []byte("newer")); !report.QuorumMet() {
+		t.Error("The honest replicas should accept a newer value: " + report.String())
+		return
+	}
+	if _, val, _ := reader.DoQuorumFindValue(key, 3); string(val) != "newer" {
+		t.Error("The newer value should be read back, got " + string(val))
+	}
+	t.Log("TestQuorumReadLyingReplica done successfully!\n")
+	return
+}
+
+func TestWriteQuorum(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// nodes holding a signed record refuse plain stores under its key
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := RecordKey(priv.Public().(ed25519.PublicKey))
+	refusing := map[string]bool{}
+	for _, k := range kList[1:4] {
+		k.records.Put(key, NewSignedRecord(priv, 1, []byte("record")))
+		refusing[k.NodeID.AsString()] = true
+	}
+	report := kList[0].IterativeStore(key, []byte("value"))
+	if !report.QuorumMet() || len(report.Accepted) == 0 {
+		t.Error("The store should succeed with the default quorum: " + report.String())
+		return
+	}
+	for _, f := range report.Failed {
+		if !refusing[f.Contact.NodeID.AsString()] {
+			t.Error("Unexpected failure: " + f.Err.Error())
+		}
+	}
+	for _, con := range report.Accepted {
+		if refusing[con.NodeID.AsString()] {
+			t.Error("A node refusing the store is reported as accepting it")
+		}
+	}
+	kList[0].WriteQuorum = len(report.Accepted) + len(report.Failed)
+	if len(report.Failed) > 0 && kList[0].IterativeStore(key, []byte("value")).QuorumMet() {
+		t.Error("The store should fail when fewer nodes than the quorum accept it")
+	}
+	kList[0].WriteQuorum = kNum
+	if res, stored := kList[0].DoIterativeStore(NewRandomID(), []byte("value")); !strings.HasPrefix(res, "ERR") || stored != nil {
+		t.Error("DoIterativeStore should fail when the quorum is not met: " + res)
+	}
+	t.Log("TestWriteQuorum done successfully!\n")
+	return
+}
+
+func TestRPCTimeout(t *testing.T) {
+	lport := testPort
+	testPort++
+	k := newTestKademlia("localhost:"+strconv.Itoa(int(lport)), nil)
+	k.rpcTimeout = 100 * time.Millisecond
+	// a peer that accepts the connection but never answers
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, connectedResponse)
+		}
+	}()
+	conn, err := dialConnect(l.Addr().String(), "/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client := rpc.NewClient(conn)
+	start := time.Now()
+	var pong PongMessage
+	err = k.call(client, "silent", "KademliaCore.Ping", PingMessage{Sender: k.selfContact(), MsgID: NewRandomID()}, &pong)
+	if err == nil || time.Since(start) > time.Second {
+		t.Error("The RPC should time out")
+	}
+	t.Log("TestRPCTimeout done successfully!\n")
+	return
+}
+
+func TestStoreBatch(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	items := []KeyValue{}
+	for i := 0; i < 10; i++ {
+		items = append(items, KeyValue{Key: NewRandomID(), Value: []byte("value" + strconv.Itoa(i))})
+	}
+	reports := kList[0].IterativeStoreBatch(items)
+	for idx, report := range reports {
+		if !report.Key.Equals(items[idx].Key) || !report.QuorumMet() {
+			t.Error("Store " + strconv.Itoa(idx) + " failed: " + report.String())
+			return
+		}
+		_, val, _ := kList[kNum-1].DoIterativeFindValue(items[idx].Key)
+		if !bytes.Equal(val, items[idx].Value) {
+			t.Error("Stored value " + strconv.Itoa(idx) + " not found")
+		}
+	}
+	t.Log("TestStoreBatch done successfully!\n")
+	return
+}
+
+func TestVanishAuthenticated(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	report, err := VanishData(kList[0], []byte("secret"), 10, 5, 0)
+	if err != nil {
+		t.Error("VanishData failed: " + err.Error())
+		return
+	}
+	vdo := report.VDO
+	data, _, err := UnvanishData(kList[kNum-1], vdo, true)
+	if err != nil || string(data) != "secret" {
+		t.Error("The data should be recovered")
+		return
+	}
+	tampered := vdo
+	tampered.Ciphertext = append([]byte{}, vdo.Ciphertext...)
+	tampered.Ciphertext[len(tampered.Ciphertext)-1] ^= 1
+	if _, _, err := UnvanishData(kList[kNum-1], tampered, true); err != ErrVDODecrypt {
+		t.Error("A tampered ciphertext should be detected")
+	}
+	truncated := vdo
+	truncated.Ciphertext = vdo.Ciphertext[:2]
+	if _, _, err := UnvanishData(kList[kNum-1], truncated, true); err != ErrVDOFormat {
+		t.Error("A truncated ciphertext should be rejected")
+	}
+	altered := vdo
+	altered.Threshold = 4
+	if _, _, err := UnvanishData(kList[kNum-1], altered, true); err != ErrVDODecrypt {
+		t.Error("Altered VDO parameters should be detected")
+	}
+	if _, err := decrypt(GenerateRandomCryptoKey(), vdo.Ciphertext, vdoAdditionalData(vdo)); err != ErrVDODecrypt {
+		t.Error("A wrong key should be detected")
+	}
+	t.Log("TestVanishAuthenticated done successfully!\n")
+	return
+}
+
+func TestSharedKeyLocations(t *testing.T) {
+	accessKey := GenerateRandomAccessKey()
+	if len(accessKey) != AccessKeySize || bytes.Equal(accessKey, GenerateRandomAccessKey()) {
+		t.Error("Access keys should be random")
+		return
+	}
+	ids := CalculateSharedKeyLocations(accessKey, 7, 10)
+	again := CalculateSharedKeyLocations(accessKey, 7, 10)
+	next := CalculateSharedKeyLocations(accessKey, 8, 10)
+	other := CalculateSharedKeyLocations(GenerateRandomAccessKey(), 7, 10)
+	seen := make(map[ID]bool)
+	for i := range ids {
+		if !ids[i].Equals(again[i]) {
+			t.Error("Locations should only depend on the access key and epoch")
+			return
+		}
+		if ids[i].Equals(next[i]) || ids[i].Equals(other[i]) {
+			t.Error("Locations should change with the epoch and the access key")
+			return
+		}
+		seen[ids[i]] = true
+	}
+	if len(seen) != len(ids) {
+		t.Error("Locations of one epoch should be distinct")
+	}
+	t.Log("TestSharedKeyLocations done successfully!\n")
+	return
+}
+
+func TestVDOEncoding(t *testing.T) {
+	vdo := VanishingDataObject{
+		AccessKey:  GenerateRandomAccessKey(),
+		Ciphertext: []byte("VDO\x01ciphertext"),
+		NumberKeys: 10,
+		Threshold:  5,
+		Epoch:      getCurrentEpoch(),
+		Expires:    time.Now().Add(time.Hour).Unix(),
+	}
+	for _, encoded := range [][]byte{EncodeVDO(vdo), ArmorVDO(vdo)} {
+		decoded, err := ParseVDO(encoded)
+		if err != nil {
+			t.Error("ParseVDO failed: " + err.Error())
+			return
+		}
+		if !bytes.Equal(decoded.AccessKey, vdo.AccessKey) || !bytes.Equal(decoded.Ciphertext, vdo.Ciphertext) ||
+			decoded.NumberKeys != vdo.NumberKeys || decoded.Threshold != vdo.Threshold || decoded.Epoch != vdo.Epoch ||
+			decoded.Expires != vdo.Expires {
+			t.Error("The VDO should survive encoding")
+			return
+		}
+	}
+	encoded := EncodeVDO(vdo)
+	if _, err := DecodeVDO(encoded[:len(encoded)-1]); err == nil {
+		t.Error("A truncated VDO should be rejected")
+	}
+	encoded[len(vdoFileMagic)] = vdoFileVersion + 1
+	if _, err := DecodeVDO(encoded); err == nil {
+		t.Error("An unknown version should be rejected")
+	}
+	if _, err := ParseVDO([]byte("garbage")); err == nil {
+		t.Error("Garbage should be rejected")
+	}
+
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	vdoID := NewRandomID()
+	if _, err := kList[0].Vanish(vdoID, []byte("exported"), 10, 5, 0); err != nil {
+		t.Error("Vanish failed: " + err.Error())
+		return
+	}
+	res, armored := kList[0].DoVanishExport(vdoID, true)
+	if armored == nil {
+		t.Error("DoVanishExport failed: " + res)
+		return
+	}
+	if res := kList[kNum-1].DoUnvanishImport(armored); res != "OK, data =>\nexported" {
+		t.Error("The imported VDO should unvanish: " + res)
+	}
+	t.Log("TestVDOEncoding done successfully!\n")
+	return
+}
+
+func TestUnvanishLocal(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	vdoID := NewRandomID()
+	if _, err := kList[0].Vanish(vdoID, []byte("local"), 10, 5, 0); err != nil {
+		t.Error("Vanish failed: " + err.Error())
+		return
+	}
+	if res := kList[0].DoUnvanishLocal(vdoID); res != "OK, data =>\nlocal" {
+		t.Error("The local VDO should unvanish: " + res)
+		return
+	}
+	if res := kList[1].DoUnvanishLocal(vdoID); !strings.HasPrefix(res, "ERR") {
+		t.Error("A VDO held by another node is not local")
+	}
+	vdo, _ := kList[0].LocalVDO(vdoID)
+	lost := vdo
+	lost.AccessKey = GenerateRandomAccessKey()
+	if _, _, err := UnvanishData(kList[1], lost, true); !errors.Is(err, ErrNotEnoughShares) {
+		t.Error("Missing shares should be reported")
+	}
+	lost.Epoch -= 2
+	if _, _, err := UnvanishData(kList[1], lost, true); !errors.Is(err, ErrVDOExpired) {
+		t.Error("An old VDO without shares should be expired")
+	}
+	t.Log("TestUnvanishLocal done successfully!\n")
+	return
+}
+
+func TestProbeEpochs(t *testing.T) {
+	current := getCurrentEpoch()
+	expires := time.Now().Add(100 * time.Hour).Unix()
+	cases := []struct {
+		created int64
+		expires int64
+		want    []int64
+	}{
+		{current, 0, []int64{current, current - 1, current + 1}},
+		{current - 1, 0, []int64{current - 1, current, current + 1}},
+		{current + 1, 0, []int64{current + 1, current, current - 1}},
+		{current - 5, 0, []int64{current, current - 1, current + 1}},
+		{current, expires, []int64{current, current - 1, current + 1}},
+		// the shares of a VDO with an expiry time live until then
+		{current - 4, expires, []int64{current - 4, current, current - 1, current + 1, current - 2, current - 3}},
+	}
+	for _, c := range cases {
+		got := probeEpochs(VanishingDataObject{Epoch: c.created, Expires: c.expires}, current)
+		if len(got) != len(c.want) {
+			t.Errorf("Wrong epochs for a VDO created in %d: %v", c.created, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("Wrong epochs for a VDO created in %d: %v", c.created, got)
+				break
+			}
+		}
+	}
+	t.Log("TestProbeEpochs done successfully!\n")
+	return
+}
+
+func TestShareIntegrity(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	report, err := VanishData(kList[0], []byte("intact"), 10, 5, 0)
+	if err != nil {
+		t.Error("VanishData failed: " + err.Error())
+		return
+	}
+	vdo := report.VDO
+	// 4 of the 10 shares are tampered with wherever they are stored
+	ids := CalculateSharedKeyLocations(vdo.AccessKey, vdo.Epoch, int64(vdo.NumberKeys))
+	for _, id := range ids[:4] {
+		for _, k := range kList {
+			if ival, ok := k.storage.Get(id); ok {
+				sv := ival.(StoredValue)
+				val := append([]byte{}, sv.Value...)
+				val[1] ^= 1
+				k.storage.Put(id, StoredValue{Value: val, Version: sv.Version})
+			}
+		}
+	}
+	data, _, err := UnvanishData(kList[kNum-1], vdo, true)
+	if err != nil || string(data) != "intact" {
+		t.Error("The tampered shares should be discarded")
+		return
+	}
+	macKey := shareMACKey(vdo.AccessKey)
+	keyMap := make(map[byte][]byte)
+	unfetched := fetchShares(kList[kNum-1], ids, macKey, int(vdo.Threshold), keyMap)
+	if len(keyMap) < int(vdo.Threshold) || len(unfetched)+len(keyMap) > len(ids) {
+		t.Error("Only the locations not looked up should be left to fetch")
+		return
+	}
+	fetchShares(kList[kNum-1], unfetched, macKey, len(ids), keyMap)
+	if len(keyMap) != len(ids)-4 {
+		t.Error("Refetching should find the remaining shares")
+	}
+	sealed := sealShare(macKey, ids[0], 1, GenerateRandomCryptoKey())
+	if _, _, ok := openShare(macKey, ids[0], sealed); !ok {
+		t.Error("A sealed share should open")
+	}
+	if _, _, ok := openShare(macKey, ids[1], sealed); ok {
+		t.Error("A share moved to another location should be rejected")
+	}
+
+	// a share with a valid tag can still be from another VDO
+	key := GenerateRandomCryptoKey()
+	other := VanishingDataObject{AccessKey: vdo.AccessKey, NumberKeys: 6, Threshold: 3}
+	other.Ciphertext, _ = encrypt(key, []byte("subset"), vdoAdditionalData(other))
+	shares, _ := sss.Split(6, 3, key)
+	shares[2] = GenerateRandomCryptoKey()
+	combined, plain, err := combineShares(other, shares)
+	if err != nil || !bytes.Equal(combined, key) || string(plain) != "subset" {
+		t.Error("Combining should retry without the bad share")
+	}
+	t.Log("TestShareIntegrity done successfully!\n")
+	return
+}
+
+func TestVanishExpiry(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	key := NewRandomID()
+	if err := kList[0].internalStore(&kList[1].SelfContact, key, []byte("short"), 1, time.Hour, false); err != nil {
+		t.Error("Store failed: " + err.Error())
+		return
+	}
+	if ival, ok := kList[1].storage.Get(key); !ok || ival.(StoredValue).Expires.IsZero() {
+		t.Error("The value should be stored with its TTL")
+		return
+	}
+	if deleted := kList[1].storage.Expire(time.Now().Add(2 * time.Hour)); deleted != 1 {
+		t.Error("The expired value should be deleted")
+	}
+	if res, _ := kList[1].LocalFindValue(key); !strings.HasPrefix(res, "ERR") {
+		t.Error("The value should be gone after its TTL")
+	}
+	kList[2].storage.Put(key, StoredValue{Value: []byte("gone"), Expires: time.Now().Add(-time.Second)})
+	if _, ok := kList[2].storage.Get(key); ok {
+		t.Error("An expired value should not be returned before it is deleted")
+	}
+
+	// the expiry is rounded up, so the shares are not expired on arrival
+	start := time.Now()
+	report, err := VanishData(kList[0], []byte("ephemeral"), 10, 5, 3*time.Second)
+	if err != nil {
+		t.Error("VanishData failed: " + err.Error())
+		return
+	}
+	vdo := report.VDO
+	if vdo.ExpiresAt().Before(start.Add(3 * time.Second)) {
+		t.Error("The VDO should not expire before its lifetime is over")
+	}
+	if data, _, err := UnvanishData(kList[kNum-1], vdo, true); err != nil || string(data) != "ephemeral" {
+		t.Error("The VDO should unvanish before it expires")
+		return
+	}
+	// a share may outlive the VDO by the time its STORE took to arrive
+	deadline := vdo.ExpiresAt().Add(time.Second)
+	ids := CalculateSharedKeyLocations(vdo.AccessKey, vdo.Epoch, int64(vdo.NumberKeys))
+	for _, id := range ids {
+		for _, k := range kList {
+			if ival, ok := k.storage.Get(id); ok && ival.(StoredValue).Expires.After(deadline) {
+				t.Error("The shares should not outlive the VDO")
+				return
+			}
+		}
+	}
+	for _, k := range kList {
+		k.storage.Expire(deadline)
+	}
+	for _, id := range ids {
+		for _, k := range kList {
+			if _, ok := k.storage.Get(id); ok {
+				t.Error("The shares should be deleted when the VDO expires")
+				return
+			}
+		}
+	}
+	expired := vdo
+	expired.Expires = time.Now().Unix()
+	if _, _, err := UnvanishData(kList[kNum-1], expired, true); !errors.Is(err, ErrVDOExpired) {
+		t.Error("The VDO should not unvanish after it expired")
+	}
+	t.Log("TestVanishExpiry done successfully!\n")
+	return
+}
+
+func TestVDOSchedule(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	path := t.TempDir() + "/vdos.json"
+	if err := kList[0].LoadVDOSchedule(path); err != nil {
+		t.Error("LoadVDOSchedule failed: " + err.Error())
+		return
+	}
+	vdoID := NewRandomID()
+	if _, err := kList[0].Vanish(vdoID, []byte("lasting"), 10, 5, 24*time.Hour); err != nil {
+		t.Error("Vanish failed: " + err.Error())
+		return
+	}
+	scheduled := kList[0].ScheduledVDOs()
+	if len(scheduled) != 1 || !scheduled[0].VdoID.Equals(vdoID) {
+		t.Error("A VDO outliving its epoch should be scheduled")
+		return
+	}
+	if next, _ := nextPush(scheduled[0].VDO, time.Now()); !scheduled[0].NextPush.Equal(next) {
+		t.Error("The shares should be pushed again at the next epoch")
+	}
+
+	// a restarted node resumes the schedule
+	if err := kList[1].LoadVDOSchedule(path); err != nil {
+		t.Error("LoadVDOSchedule failed: " + err.Error())
+		return
+	}
+	if len(kList[1].ScheduledVDOs()) != 1 {
+		t.Error("The schedule should be resumed from the state file")
+		return
+	}
+	if res := kList[1].DoUnvanishLocal(vdoID); res != "OK, data =>\nlasting" {
+		t.Error("The resumed VDO should be held by the node: " + res)
+	}
+
+	// a due push runs at once
+	kList[1].vdos.lock.Lock()
+	kList[1].vdos.scheduled[vdoID.AsString()].NextPush = time.Now()
+	kList[1].vdos.lock.Unlock()
+	kList[1].vdos.notify()
+	pushed := false
+	for i := 0; i < 50 && !pushed; i++ {
+		time.Sleep(100 * time.Millisecond)
+		for _, s := range kList[1].ScheduledVDOs() {
+			pushed = !s.LastPush.IsZero() && s.Failures == 0
+		}
+	}
+	if !pushed {
+		t.Error("The due VDO should have been pushed again")
+	}
+
+	old, _ := kList[0].LocalVDO(vdoID)
+	if res := kList[0].DoVDOExtend(vdoID, time.Hour); !strings.HasPrefix(res, "OK") {
+		t.Error("DoVDOExtend failed: " + res)
+		return
+	}
+	extended, _ := kList[0].LocalVDO(vdoID)
+	if extended.Expires != old.Expires+3600 {
+		t.Error("The VDO should expire an hour later")
+	}
+	if res := kList[0].DoUnvanishLocal(vdoID); res != "OK, data =>\nlasting" {
+		t.Error("The extended VDO should unvanish: " + res)
+	}
+
+	if res := kList[0].DoVDOCancel(vdoID); !strings.HasPrefix(res, "OK") {
+		t.Error("DoVDOCancel failed: " + res)
+	}
+	if res := kList[0].DoVDOCancel(vdoID); !strings.HasPrefix(res, "ERR") {
+		t.Error("A cancelled VDO is not scheduled anymore")
+	}
+	kList[2].LoadVDOSchedule(path)
+	if len(kList[2].ScheduledVDOs()) != 0 {
+		t.Error("The cancellation should be saved")
+	}
+	t.Log("TestVDOSchedule done successfully!\n")
+	return
+}
+
+// A node down for several epochs missed the re-pushes of its VDOs: it finds
+// their shares where they were last pushed and pushes them again.
+func TestVDOResumeAfterEpochs(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	current := getCurrentEpoch()
+	vdo := VanishingDataObject{AccessKey: GenerateRandomAccessKey(), NumberKeys: 10, Threshold: 5,
+		Epoch: current - 3, Expires: expiresUnix(time.Now().Add(48 * time.Hour))}
+	key := GenerateRandomCryptoKey()
+	vdo.Ciphertext, _ = encrypt(key, []byte("resumed"), vdoAdditionalData(vdo))
+	if _, err := pushShareKeys(kList[0], vdo, key, vdo.Epoch); err != nil {
+		t.Error("Failed to push the shares: " + err.Error())
+		return
+	}
+	path := t.TempDir() + "/vdos.json"
+	kList[0].LoadVDOSchedule(path)
+	vdoID := NewRandomID()
+	kList[0].vdos.Schedule(vdoID, vdo)
+
+	kList[1].LoadVDOSchedule(path)
+	kList[1].vdos.lock.Lock()
+	kList[1].vdos.scheduled[vdoID.AsString()].NextPush = time.Now()
+	kList[1].vdos.lock.Unlock()
+	kList[1].vdos.notify()
+	var s ScheduledVDO
+	for i := 0; i < 50 && s.LastPush.IsZero() && s.Failures == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		s = kList[1].ScheduledVDOs()[0]
+	}
+	if s.LastPush.IsZero() {
+		t.Error("The missed push should have been made: " + s.LastErr)
+		return
+	}
+	ids := CalculateSharedKeyLocations(vdo.AccessKey, current, int64(vdo.NumberKeys))
+	keyMap := make(map[byte][]byte)
+	fetchShares(kList[2], ids, shareMACKey(vdo.AccessKey), len(ids), keyMap)
+	if len(keyMap) < int(vdo.Threshold) {
+		t.Error("The shares should have been pushed for the current epoch")
+	}
+	t.Log("TestVDOResumeAfterEpochs done successfully!\n")
+	return
+}
+
+func TestVanishReport(t *testing.T) {
+	kNum := 20
+	treeList := GenerateTreeIDList(kNum)
+	kList, _ := GenerateTestList(kNum, treeList)
+	for i := 1; i < kNum; i++ {
+		kList.ConnectTo(i, i/divNum)
+	}
+	time.Sleep(100 * time.Millisecond)
+	vdoID := NewRandomID()
+	report, err := kList[0].Vanish(vdoID, []byte("reported"), 10, 5, 0)
+	if err != nil {
+		t.Error("Vanish failed: " + err.Error())
+		return
+	}
+	if report.Attempted() != 10 || report.Stored != 10 || !report.Succeeded() {
+		t.Error("All the shares should be stored: " + report.String())
+	}
+	for _, share := range report.Shares {
+		if len(share.Accepted) == 0 {
+			t.Error("Every share should be stored on some node")
+		}
+	}
+	if !strings.HasPrefix(report.String(), "OK") {
+		t.Error("The report should succeed: " + report.String())
+	}
+	if vdo, ok := kList[0].LocalVDO(vdoID); !ok || !bytes.Equal(vdo.AccessKey, report.VDO.AccessKey) {
+		t.Error("The reported VDO should be kept")
+	}
+
+	// an isolated node cannot store any share
+	alone, _ := GenerateTestList(1, nil)
+	report, err = alone[0].Vanish(vdoID, []byte("reported"), 10, 5, 0)
+	if !errors.Is(err, ErrSharesNotStored) || report.Attempted() != 10 || report.Stored != 0 {
+		t.Error("Vanishing without peers should fail")
+	}
+	if !strings.HasPrefix(report.String(), "ERR") {
+		t.Error("The report should fail: " + report.String())
+	}
+	if _, ok := alone[0].LocalVDO(vdoID); ok {
+		t.Error("A failed VDO should not be kept")
+	}
+	t.Log("TestVanishReport done successfully!\n")
+	return
+}
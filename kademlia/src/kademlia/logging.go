@@ -0,0 +1,39 @@
+package kademlia
+
+// Contains the logging helpers shared by every part of the node. Log records
+// carry key/value fields: node_id for the node logging, peer for the other
+// side of an RPC, rpc for its type and msg_id for its message ID.
+
+import (
+	"io"
+	"log/slog"
+)
+
+// A text logger writing records at level and above to w.
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// Every RPC request and reply carries a MsgID, this gets it for logging.
+type identifiedMessage interface {
+	messageID() ID
+}
+
+func (m PingMessage) messageID() ID         { return m.MsgID }
+func (m StoreRequest) messageID() ID        { return m.MsgID }
+func (m AppendRequest) messageID() ID       { return m.MsgID }
+func (m StoreRecordRequest) messageID() ID  { return m.MsgID }
+func (m FindNodeRequest) messageID() ID     { return m.MsgID }
+func (m FindValueRequest) messageID() ID    { return m.MsgID }
+func (m GetVDORequest) messageID() ID       { return m.MsgID }
+func (m ReachabilityRequest) messageID() ID { return m.MsgID }
+func (m RelayConnectRequest) messageID() ID { return m.MsgID }
+
+// The fields describing an RPC exchanged with peer.
+func rpcFields(serviceMethod string, peer string, msg interface{}) []interface{} {
+	fields := []interface{}{"rpc", rpcName(serviceMethod), "peer", peer}
+	if m, ok := msg.(identifiedMessage); ok {
+		fields = append(fields, "msg_id", m.messageID().AsString())
+	}
+	return fields
+}
@@ -0,0 +1,232 @@
+package kademlia
+
+// Contains the counters and histograms describing what a node is doing, and
+// the HTTP handler exposing them in the Prometheus text exposition format on
+// MetricsPath.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MetricsPath = "/metrics"
+
+var (
+	latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	hopBuckets     = []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(buffer *bytes.Buffer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(buffer, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, h.counts[i])
+	}
+	fmt.Fprintf(buffer, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(buffer, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(buffer, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type Metrics struct {
+	lock           sync.Mutex
+	rpcsSent       map[string]uint64
+	rpcsFailed     map[string]uint64
+	rpcsReceived   map[string]uint64
+	rpcLatency     map[string]*histogram
+	lookupHops     *histogram
+	lookupDuration *histogram
+	vdoPushes      uint64
+	vdoFailures    uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		rpcsSent:       make(map[string]uint64),
+		rpcsFailed:     make(map[string]uint64),
+		rpcsReceived:   make(map[string]uint64),
+		rpcLatency:     make(map[string]*histogram),
+		lookupHops:     newHistogram(hopBuckets),
+		lookupDuration: newHistogram(latencyBuckets),
+	}
+}
+
+// "KademliaCore.Ping" => "Ping"
+func rpcName(serviceMethod string) string {
+	return serviceMethod[strings.LastIndex(serviceMethod, ".")+1:]
+}
+
+func (m *Metrics) rpcSent(serviceMethod string, latency time.Duration, err error) {
+	name := rpcName(serviceMethod)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rpcsSent[name]++
+	if err != nil {
+		m.rpcsFailed[name]++
+	}
+	h, ok := m.rpcLatency[name]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.rpcLatency[name] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+func (m *Metrics) rpcReceived(serviceMethod string) {
+	m.lock.Lock()
+	m.rpcsReceived[rpcName(serviceMethod)]++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) lookupDone(hops int, duration time.Duration) {
+	m.lock.Lock()
+	m.lookupHops.observe(float64(hops))
+	m.lookupDuration.observe(duration.Seconds())
+	m.lock.Unlock()
+}
+
+func (m *Metrics) vdoPushed(ok bool) {
+	m.lock.Lock()
+	m.vdoPushes++
+	if !ok {
+		m.vdoFailures++
+	}
+	m.lock.Unlock()
+}
+
+func writeHeader(buffer *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeByRPC(buffer *bytes.Buffer, name string, values map[string]uint64) {
+	names := []string{}
+	for rpc := range values {
+		names = append(names, rpc)
+	}
+	sort.Strings(names)
+	for _, rpc := range names {
+		fmt.Fprintf(buffer, "%s{rpc=%q} %d\n", name, rpc, values[rpc])
+	}
+}
+
+func (m *Metrics) write(buffer *bytes.Buffer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	writeHeader(buffer, "kademlia_rpcs_sent_total", "counter", "RPCs sent, by type.")
+	writeByRPC(buffer, "kademlia_rpcs_sent_total", m.rpcsSent)
+	writeHeader(buffer, "kademlia_rpcs_failed_total", "counter", "RPCs sent that failed, by type.")
+	writeByRPC(buffer, "kademlia_rpcs_failed_total", m.rpcsFailed)
+	writeHeader(buffer, "kademlia_rpcs_received_total", "counter", "RPCs received, by type.")
+	writeByRPC(buffer, "kademlia_rpcs_received_total", m.rpcsReceived)
+
+	writeHeader(buffer, "kademlia_rpc_latency_seconds", "histogram", "Latency of RPCs sent, by type.")
+	names := []string{}
+	for rpc := range m.rpcLatency {
+		names = append(names, rpc)
+	}
+	sort.Strings(names)
+	for _, rpc := range names {
+		m.rpcLatency[rpc].write(buffer, "kademlia_rpc_latency_seconds", fmt.Sprintf("rpc=%q", rpc))
+	}
+
+	writeHeader(buffer, "kademlia_lookup_hops", "histogram", "Rounds of queries per iterative lookup.")
+	m.lookupHops.write(buffer, "kademlia_lookup_hops", "")
+	writeHeader(buffer, "kademlia_lookup_duration_seconds", "histogram", "Duration of iterative lookups.")
+	m.lookupDuration.write(buffer, "kademlia_lookup_duration_seconds", "")
+
+	writeHeader(buffer, "kademlia_vdo_share_pushes_total", "counter", "VDO key shares pushed to the DHT.")
+	fmt.Fprintf(buffer, "kademlia_vdo_share_pushes_total %d\n", m.vdoPushes)
+	writeHeader(buffer, "kademlia_vdo_share_push_failures_total", "counter", "VDO key shares that could not be stored.")
+	fmt.Fprintf(buffer, "kademlia_vdo_share_push_failures_total %d\n", m.vdoFailures)
+}
+
+// Perform an RPC on peer, recording it in the metrics and the log. The client
+// is closed if peer does not answer within the RPC timeout.
+func (k *Kademlia) call(client *rpc.Client, peer string, serviceMethod string, args interface{}, reply interface{}) error {
+	start := time.Now()
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(k.rpcTimeout):
+		// closing the client fails the call, after which reply is no
+		// longer written to
+		client.Close()
+		<-call.Done
+		err = errors.New("RPC timed out after " + k.rpcTimeout.String())
+	}
+	latency := time.Since(start)
+	k.metrics.rpcSent(serviceMethod, latency, err)
+	fields := append(rpcFields(serviceMethod, peer, args), "latency", latency)
+	if err != nil {
+		k.log.Warn("rpc failed", append(fields, "err", err)...)
+	} else {
+		k.log.Debug("rpc sent", fields...)
+	}
+	return err
+}
+
+func (k *Kademlia) getBucketSizes() (ret []int) {
+	resCh := make(chan []int)
+	k.bucketSizeChannel <- routingRequest{k.NodeID, 0, resCh}
+	ret = <-resCh
+	close(resCh)
+	return
+}
+
+func (k *Kademlia) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	var buffer bytes.Buffer
+	k.metrics.write(&buffer)
+
+	writeHeader(&buffer, "kademlia_routing_table_contacts", "gauge", "Contacts in each non-empty k-bucket.")
+	for idx, size := range k.getBucketSizes() {
+		if size > 0 {
+			fmt.Fprintf(&buffer, "kademlia_routing_table_contacts{bucket=\"%d\"} %d\n", idx, size)
+		}
+	}
+	keys, size := k.storage.Stats()
+	setKeys, setSize := k.valueSets.Stats()
+	recordKeys, recordSize := k.records.Stats()
+	keys += setKeys + recordKeys
+	size += setSize + recordSize
+	writeHeader(&buffer, "kademlia_stored_keys", "gauge", "Keys in local storage.")
+	fmt.Fprintf(&buffer, "kademlia_stored_keys %d\n", keys)
+	writeHeader(&buffer, "kademlia_stored_bytes", "gauge", "Bytes of values in local storage.")
+	fmt.Fprintf(&buffer, "kademlia_stored_bytes %d\n", size)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
@@ -0,0 +1,124 @@
+package kademlia
+
+// Contains quorum reads: instead of trusting the first replica that answers,
+// the closest nodes are asked until enough of them agree on the newest
+// version of the value, and the ones holding an older version or none get
+// the newest one stored back (read-repair). A value only counts once a quorum
+// of replicas hold it, so a single replica claiming a newer version can
+// neither win the read nor be copied onto the others.
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// how far ahead of the local clock the version of a stored value may be
+const maxVersionSkew = time.Minute
+
+// What one replica answered to a FIND_VALUE.
+type replicaValue struct {
+	contact Contact
+	value   []byte
+	version int64
+	ttl     time.Duration
+}
+
+func (r *replicaValue) matches(other *replicaValue) bool {
+	return r.version == other.version && bytes.Equal(r.value, other.value)
+}
+
+// The newest value held by at least quorum of the replies, or the one most
+// of them agree on if none is, and how many agree on it. newer tells whether
+// some reply claims a newer value.
+func agreedValue(replies []*replicaValue, quorum int) (best *replicaValue, matching int, newer bool) {
+	for _, r := range replies {
+		if r.value == nil {
+			continue
+		}
+		count := 0
+		for _, other := range replies {
+			if r.matches(other) {
+				count++
+			}
+		}
+		if best == nil ||
+			count >= quorum && (matching < quorum || r.version > best.version) ||
+			matching < quorum && (count > matching || count == matching && r.version > best.version) {
+			best, matching = r, count
+		}
+	}
+	for _, r := range replies {
+		if best != nil && r.value != nil && r.version > best.version {
+			newer = true
+		}
+	}
+	return
+}
+
+// Ask the k closest nodes to key, alpha at a time and closest first, until
+// quorum of them agree on a value and none claims a newer one. Returns the
+// newest value a quorum agrees on if any, how many replicas hold it and every
+// node that answered.
+func (k *Kademlia) quorumRead(key ID, quorum int) (newest *replicaValue, matching int, replies []*replicaValue) {
+	closest := k.internalIterative(key, false, false, nil).activeContactList
+	newer := false
+	for start := 0; start < len(closest) && (matching < quorum || newer); start += alpha {
+		end := start + alpha
+		if end > len(closest) {
+			end = len(closest)
+		}
+		ch := make(chan *replicaValue, end-start)
+		for _, con := range closest[start:end] {
+			go func(con Contact) {
+				res, ok := k.internalFindValue(&con, key, 0)
+				if !ok {
+					ch <- nil
+					return
+				}
+				ch <- &replicaValue{con, res.Value, res.Version, res.TTL}
+			}(con)
+		}
+		for i := start; i < end; i++ {
+			if r := <-ch; r != nil {
+				replies = append(replies, r)
+			}
+		}
+		newest, matching, newer = agreedValue(replies, quorum)
+	}
+	return
+}
+
+// Store newest back on the nodes that answered with an older value or none.
+func (k *Kademlia) readRepair(key ID, newest *replicaValue, replies []*replicaValue) (repaired int) {
+	for _, r := range replies {
+		if r.value != nil && r.version >= newest.version {
+			continue
+		}
+		// the repaired replica expires with the others
+		if k.internalStore(&r.contact, key, newest.value, newest.version, newest.ttl, false) == nil {
+			repaired++
+		}
+	}
+	return
+}
+
+// Read key from the closest nodes until quorum of them agree on its newest
+// version, then read-repair the others. Fails, repairing nothing, if no
+// value is held by quorum replicas.
+func (k *Kademlia) DoQuorumFindValue(key ID, quorum int) (string, []byte, []Contact) {
+	newest, matching, replies := k.quorumRead(key, quorum)
+	if newest == nil {
+		return "ERR", nil, nil
+	}
+	if matching < quorum {
+		return "ERR: Only " + strconv.Itoa(matching) + " of " + strconv.Itoa(quorum) +
+			" replicas agree on a value", nil, nil
+	}
+	repaired := k.readRepair(key, newest, replies)
+	res := newest.contact.NodeID.AsString() + " => " + string(newest.value)
+	if repaired > 0 {
+		res += " (repaired " + strconv.Itoa(repaired) + " replicas)"
+	}
+	return res, newest.value, nil
+}
@@ -0,0 +1,183 @@
+package kademlia
+
+// Contains the signed records used for mutable data. A record is stored under
+// the hash of the public key that signs it, so only the holder of the private
+// key can write there, and a node only replaces a record with one carrying a
+// higher sequence number.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const recordDomain = "kademlia-record\x00"
+
+type SignedRecord struct {
+	PublicKey ed25519.PublicKey
+	Seq       uint64
+	Value     []byte
+	Signature []byte
+}
+
+// The key a record signed by pub is stored under.
+func RecordKey(pub ed25519.PublicKey) ID {
+	return ContentID(pub)
+}
+
+func recordMessage(seq uint64, value []byte) []byte {
+	msg := make([]byte, len(recordDomain)+8, len(recordDomain)+8+len(value))
+	copy(msg, recordDomain)
+	binary.BigEndian.PutUint64(msg[len(recordDomain):], seq)
+	return append(msg, value...)
+}
+
+func NewSignedRecord(priv ed25519.PrivateKey, seq uint64, value []byte) *SignedRecord {
+	return &SignedRecord{
+		PublicKey: priv.Public().(ed25519.PublicKey),
+		Seq:       seq,
+		Value:     value,
+		Signature: ed25519.Sign(priv, recordMessage(seq, value)),
+	}
+}
+
+// Check that the record may be stored under key and is signed by its key.
+func (r *SignedRecord) Verify(key ID) error {
+	if len(r.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("Invalid record public key")
+	}
+	if !RecordKey(r.PublicKey).Equals(key) {
+		return errors.New("Record public key does not match key " + key.AsString())
+	}
+	if !ed25519.Verify(r.PublicKey, recordMessage(r.Seq, r.Value), r.Signature) {
+		return errors.New("Invalid record signature")
+	}
+	return nil
+}
+
+// Read an ed25519 seed from path, hex encoded, or create the file with a new
+// one if it does not exist.
+func LoadOrCreateRecordKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return priv, os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Invalid record key in " + path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+type RecordStorage struct {
+	storage map[string]*SignedRecord
+	lock    sync.Mutex
+}
+
+func NewRecordStorage() *RecordStorage {
+	return &RecordStorage{storage: make(map[string]*SignedRecord)}
+}
+
+func (rs *RecordStorage) Get(key ID) (*SignedRecord, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	r, ok := rs.storage[key.AsString()]
+	return r, ok
+}
+
+// Store r under key if it is valid and newer than what we hold.
+func (rs *RecordStorage) Put(key ID, r *SignedRecord) error {
+	if err := r.Verify(key); err != nil {
+		return err
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if old, ok := rs.storage[key.AsString()]; ok && old.Seq >= r.Seq {
+		return errors.New("Record sequence number " + strconv.FormatUint(r.Seq, 10) +
+			" is not above " + strconv.FormatUint(old.Seq, 10))
+	}
+	rs.storage[key.AsString()] = r
+	return nil
+}
+
+func (rs *RecordStorage) Stats() (keys int, size int) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for _, r := range rs.storage {
+		size += len(r.Value)
+	}
+	return len(rs.storage), size
+}
+
+func (k *Kademlia) internalStoreRecord(contact *Contact, key ID, r *SignedRecord) error {
+	client := k.dialContact(contact)
+	if client == nil {
+		return errors.New("Failed to connect to " + contact.NodeID.AsString())
+	}
+	defer client.Close()
+	req := StoreRecordRequest{k.selfContact(), NewRandomID(), key, *r}
+	var res StoreRecordResult
+	err := k.call(client, contact.NodeID.AsString(), "KademliaCore.StoreRecord", req, &res)
+	if _, refused := err.(rpc.ServerError); err != nil && !refused {
+		k.contactFailed(contact.NodeID)
+	}
+	if err == nil && !res.MsgID.Equals(req.MsgID) {
+		err = errors.New("Mismatched message ID")
+	}
+	return err
+}
+
+// The highest sequence valid record held by the k closest nodes to key, nil
+// if none holds one.
+func (k *Kademlia) findLatestRecord(key ID) (latest *SignedRecord, from Contact) {
+	resp := k.internalIterative(key, false, false, nil)
+	for _, con := range resp.activeContactList {
+		res, ok := k.internalFindValue(&con, key, 0)
+		if !ok || res.Record == nil {
+			continue
+		}
+		if err := res.Record.Verify(key); err != nil {
+			k.log.Warn("invalid record", "peer", con.NodeID.AsString(), "key", key.AsString(), "err", err)
+			k.contactMisbehaved(con.NodeID)
+			continue
+		}
+		if latest == nil || res.Record.Seq > latest.Seq {
+			latest = res.Record
+			from = con
+		}
+	}
+	return
+}
+
+// Sign value with priv, one sequence number above the latest record found,
+// and store it on the k closest nodes to the key of priv.
+func (k *Kademlia) DoIterativePutRecord(priv ed25519.PrivateKey, value []byte) (string, *SignedRecord, []Contact) {
+	key := RecordKey(priv.Public().(ed25519.PublicKey))
+	seq := uint64(1)
+	if latest, _ := k.findLatestRecord(key); latest != nil {
+		seq = latest.Seq + 1
+	}
+	r := NewSignedRecord(priv, seq, value)
+	report := k.storeOnClosest(key, func(con *Contact) error {
+		return k.internalStoreRecord(con, key, r)
+	})
+	if !report.QuorumMet() {
+		return report.String(), nil, nil
+	}
+	return "OK: " + key.AsString() + " seq " + strconv.FormatUint(seq, 10) + ", " +
+		strings.TrimPrefix(report.String(), "OK: "), r, report.Accepted
+}
@@ -0,0 +1,368 @@
+package kademlia
+
+// Contains the reachability check a node behind a NAT uses to find out that
+// nobody can dial it, and the relaying that lets such a node still be
+// reached. The relayed node keeps a control connection open to its relay; when
+// somebody wants to talk to it, the relay asks it over that connection to dial
+// back, and splices the two connections together.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relayControlPath  = "/_kademlia_relay_control_/"
+	relayPath         = "/_kademlia_relay_/"
+	relayBackPath     = "/_kademlia_relay_back_/"
+	connectedResponse = "HTTP/1.0 200 Connected to Go RPC\n\n"
+	reachabilityPeers = 3
+	relayTimeout      = 5 * time.Second
+	// how many reachability checks an address gets per dialBackWindow
+	dialBacksPerWindow = 10
+	dialBackWindow     = time.Minute
+)
+
+// Limits the dial-backs of reachability checks, so that nodes cannot make us
+// connect over and over to some address.
+type dialBackLimiter struct {
+	lock   sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// Whether ip may be dialed back once more in the current window.
+func (l *dialBackLimiter) allow(ip net.IP, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.start) >= dialBackWindow {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[ip.String()] >= dialBacksPerWindow {
+		return false
+	}
+	l.counts[ip.String()]++
+	return true
+}
+
+// Address of a node relaying RPCs for a contact that cannot be dialed
+// directly.
+type RelayAddr struct {
+	NodeID ID
+	Host   net.IP
+	Port   uint16
+}
+
+// A connection whose first bytes may already sit in a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Take over the connection of an HTTP CONNECT request. The caller still has
+// to write connectedResponse before using it.
+func hijack(w http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return nil, errors.New("Not a CONNECT request")
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedConn{conn, buf.Reader}, nil
+}
+
+// The client side of hijack.
+func dialConnect(addr string, path string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, relayTimeout)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err == nil && resp.StatusCode == http.StatusOK {
+		return &bufferedConn{conn, r}, nil
+	}
+	if err == nil {
+		err = errors.New("Unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, err
+}
+
+// Copy between the two connections until one of them is done.
+func splice(a, b net.Conn) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- true
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- true
+	}()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// Dial a relayed node through one of its relays.
+func getRelayedClient(relay RelayAddr, nodeId ID) *rpc.Client {
+	conn, err := dialConnect(JoinHostPort(relay.Host, relay.Port), relayPath+nodeId.AsString())
+	if err != nil {
+		return nil
+	}
+	return rpc.NewClient(conn)
+}
+
+// Whether the node at the other end of a control connection answers as
+// nodeId.
+func (k *Kademlia) pingRelayed(client *rpc.Client, nodeId ID) bool {
+	ping := PingMessage{Sender: k.selfContact(), MsgID: NewRandomID()}
+	var pong PongMessage
+	err := k.call(client, nodeId.AsString(), "KademliaCore.Ping", ping, &pong)
+	return err == nil && pong.MsgID.Equals(ping.MsgID) && pong.Sender.NodeID.Equals(nodeId)
+}
+
+// A relayed node opens its control connection here. Node IDs are not bound
+// to keys, so the node is only required to answer as the node ID it
+// registers for, and a registration still answering is never replaced.
+func (k *Kademlia) serveRelayControl(w http.ResponseWriter, req *http.Request) {
+	nodeId, err := IDFromString(strings.TrimPrefix(req.URL.Path, relayControlPath))
+	if err != nil {
+		http.Error(w, "Invalid node ID", http.StatusBadRequest)
+		return
+	}
+	k.relayLock.Lock()
+	old := k.relayed[nodeId.AsString()]
+	k.relayLock.Unlock()
+	if old != nil && k.pingRelayed(old, nodeId) {
+		http.Error(w, "Already relaying for "+nodeId.AsString(), http.StatusConflict)
+		return
+	}
+	conn, err := hijack(w, req)
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, connectedResponse)
+	client := rpc.NewClient(conn)
+	if !k.pingRelayed(client, nodeId) {
+		k.log.Warn("relay registration refused", "peer", nodeId.AsString(), "remote", req.RemoteAddr)
+		client.Close()
+		return
+	}
+	k.relayLock.Lock()
+	if cur := k.relayed[nodeId.AsString()]; cur != old {
+		// somebody else registered meanwhile
+		k.relayLock.Unlock()
+		client.Close()
+		return
+	}
+	if old != nil {
+		old.Close()
+	}
+	k.relayed[nodeId.AsString()] = client
+	k.relayLock.Unlock()
+	k.log.Info("relaying for node", "peer", nodeId.AsString())
+}
+
+// Somebody wants to talk to a node we relay for.
+func (k *Kademlia) serveRelay(w http.ResponseWriter, req *http.Request) {
+	nodeId, err := IDFromString(strings.TrimPrefix(req.URL.Path, relayPath))
+	if err != nil {
+		http.Error(w, "Invalid node ID", http.StatusBadRequest)
+		return
+	}
+	k.relayLock.Lock()
+	client, ok := k.relayed[nodeId.AsString()]
+	k.relayLock.Unlock()
+	if !ok {
+		http.Error(w, "Not relaying for "+nodeId.AsString(), http.StatusNotFound)
+		return
+	}
+	token := NewRandomID().AsString()
+	back := make(chan net.Conn, 1)
+	k.relayLock.Lock()
+	k.relayPending[token] = back
+	k.relayLock.Unlock()
+	defer func() {
+		k.relayLock.Lock()
+		delete(k.relayPending, token)
+		k.relayLock.Unlock()
+	}()
+
+	conn, err := hijack(w, req)
+	if err != nil {
+		return
+	}
+	go func() {
+		connReq := RelayConnectRequest{NewRandomID(), k.NodeID, token}
+		var connRes RelayConnectResult
+		err := k.call(client, nodeId.AsString(), "KademliaCore.RelayConnect", connReq, &connRes)
+		if err == rpc.ErrShutdown {
+			// the control connection is gone, so is the relayed node
+			k.relayLock.Lock()
+			if k.relayed[nodeId.AsString()] == client {
+				delete(k.relayed, nodeId.AsString())
+			}
+			k.relayLock.Unlock()
+		}
+	}()
+	select {
+	case b := <-back:
+		io.WriteString(conn, connectedResponse)
+		splice(conn, b)
+	case <-time.After(relayTimeout):
+		conn.Close()
+	}
+}
+
+// The relayed node dials back here after RelayConnect.
+func (k *Kademlia) serveRelayBack(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, relayBackPath)
+	k.relayLock.Lock()
+	back, ok := k.relayPending[token]
+	k.relayLock.Unlock()
+	if !ok {
+		http.Error(w, "Unknown relay token", http.StatusNotFound)
+		return
+	}
+	conn, err := hijack(w, req)
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, connectedResponse)
+	select {
+	case back <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (k *Kademlia) findRelay(relayId ID) (RelayAddr, bool) {
+	self := k.selfContact()
+	for _, relay := range self.Relays {
+		if relay.NodeID.Equals(relayId) {
+			return relay, true
+		}
+	}
+	return RelayAddr{}, false
+}
+
+func (k *Kademlia) removeRelay(relayId ID) {
+	k.selfLock.Lock()
+	defer k.selfLock.Unlock()
+	relays := []RelayAddr{}
+	for _, relay := range k.SelfContact.Relays {
+		if !relay.NodeID.Equals(relayId) {
+			relays = append(relays, relay)
+		}
+	}
+	k.SelfContact.Relays = relays
+}
+
+// Keep a control connection open to relay and advertise it in our contact,
+// so other nodes reach us through it.
+func (k *Kademlia) RegisterRelay(relay *Contact) error {
+	err := errors.New("Relay has no address")
+	for _, host := range relay.Addresses() {
+		var conn net.Conn
+		conn, err = dialConnect(JoinHostPort(host, relay.Port), relayControlPath+k.NodeID.AsString())
+		if err != nil {
+			continue
+		}
+		k.removeRelay(relay.NodeID)
+		k.selfLock.Lock()
+		relays := append([]RelayAddr{}, k.SelfContact.Relays...)
+		k.SelfContact.Relays = append(relays, RelayAddr{relay.NodeID, host, relay.Port})
+		k.SelfContact.ClientOnly = false
+		k.selfLock.Unlock()
+		k.log.Info("registered with relay", "peer", relay.NodeID.AsString())
+		go func() {
+			k.server.ServeCodec(newObservingServerCodec(conn, nil, k))
+			// the relay went away, stop advertising it
+			k.log.Warn("lost connection to relay", "peer", relay.NodeID.AsString())
+			k.removeRelay(relay.NodeID)
+		}()
+		return nil
+	}
+	return err
+}
+
+// A client-only node never shows up in other nodes' k-buckets.
+func (k *Kademlia) SetClientOnly(clientOnly bool) {
+	k.selfLock.Lock()
+	k.SelfContact.ClientOnly = clientOnly
+	k.selfLock.Unlock()
+}
+
+// Ask a few of our closest peers to dial us back. We are reachable as soon as
+// one of them succeeds. The peers that answered are returned as candidate
+// relays.
+func (k *Kademlia) CheckReachability() (reachable bool, peers []Contact, err error) {
+	for _, con := range k.getLastContactFromRoutingTable(k.NodeID) {
+		if len(peers) >= reachabilityPeers {
+			break
+		}
+		client := GetContactClient(&con)
+		if client == nil {
+			continue
+		}
+		req := ReachabilityRequest{Sender: k.selfContact(), MsgID: NewRandomID()}
+		var res ReachabilityResult
+		err := k.call(client, con.NodeID.AsString(), "KademliaCore.CheckReachability", req, &res)
+		client.Close()
+		if err != nil || !res.MsgID.Equals(req.MsgID) {
+			continue
+		}
+		k.observeSelfAddress(con.NodeID, res.Observed)
+		peers = append(peers, con)
+		if res.Reachable {
+			reachable = true
+		}
+	}
+	if len(peers) == 0 {
+		err = errors.New("No peer answered the reachability check")
+	}
+	return
+}
+
+// Check whether we can be dialed and, if not, register with a relay or fall
+// back to being a client-only node.
+func (k *Kademlia) DoNATCheck() string {
+	reachable, peers, err := k.CheckReachability()
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	if reachable {
+		k.SetClientOnly(false)
+		return "OK: reachable"
+	}
+	for _, peer := range peers {
+		// a relay has to be reachable itself
+		if len(peer.Relays) > 0 || peer.ClientOnly {
+			continue
+		}
+		if k.RegisterRelay(&peer) == nil {
+			return "OK: unreachable, relayed by " + peer.NodeID.AsString()
+		}
+	}
+	k.SetClientOnly(true)
+	return "OK: unreachable, running as client only"
+}
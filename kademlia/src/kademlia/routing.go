@@ -0,0 +1,103 @@
+package kademlia
+
+// Contains the bookkeeping kept next to the k-buckets (when each contact was
+// last seen and how many RPCs to it failed since) and the snapshot of the
+// routing table built from both.
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// how long a contact that misbehaved is kept out of the k-buckets, which
+// Kademlia.banned tracks from handleUpdate
+const misbehaviorBan = time.Hour
+
+// Only ever touched from handleUpdate.
+type contactStats struct {
+	LastSeen time.Time
+	Failures int
+}
+
+type ContactSnapshot struct {
+	Contact  Contact
+	LastSeen time.Time
+	// failed RPCs since the contact was last seen
+	Failures int
+}
+
+// Contacts are in LRU order: least recently seen first.
+type BucketSnapshot struct {
+	Index    int
+	Contacts []ContactSnapshot
+}
+
+func (c ContactSnapshot) MarshalJSON() ([]byte, error) {
+	alts := []string{}
+	for _, alt := range c.Contact.AltHosts {
+		alts = append(alts, alt.String())
+	}
+	return json.Marshal(struct {
+		NodeID   string    `json:"node_id"`
+		Host     string    `json:"host"`
+		Port     uint16    `json:"port"`
+		AltHosts []string  `json:"alt_hosts"`
+		Relayed  bool      `json:"relayed"`
+		LastSeen time.Time `json:"last_seen"`
+		Failures int       `json:"failures"`
+	}{c.Contact.NodeID.AsString(), c.Contact.Host.String(), c.Contact.Port, alts,
+		len(c.Contact.Relays) > 0, c.LastSeen, c.Failures})
+}
+
+func (b BucketSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Index    int               `json:"index"`
+		Contacts []ContactSnapshot `json:"contacts"`
+	}{b.Index, b.Contacts})
+}
+
+func (k *Kademlia) contactSeen(nodeId ID) {
+	k.contactStats[nodeId.AsString()] = &contactStats{LastSeen: time.Now()}
+}
+
+// Count a failed RPC against a contact.
+func (k *Kademlia) contactFailed(nodeId ID) {
+	k.failureChannel <- nodeId
+}
+
+// Evict a contact that answered with a value it cannot hold, such as a record
+// failing verification, and keep it out of the k-buckets for misbehaviorBan.
+func (k *Kademlia) contactMisbehaved(nodeId ID) {
+	k.misbehaveChannel <- nodeId
+}
+
+// Must run in handleUpdate.
+func (k *Kademlia) snapshotRoutingTable() (ret []BucketSnapshot) {
+	ret = []BucketSnapshot{}
+	for idx, bucket := range k.routingTable {
+		if bucket.Len() == 0 {
+			continue
+		}
+		b := BucketSnapshot{Index: idx, Contacts: []ContactSnapshot{}}
+		for e := bucket.Front(); e != nil; e = e.Next() {
+			c := e.Value.(Contact)
+			cs := ContactSnapshot{Contact: c}
+			if stats, ok := k.contactStats[c.NodeID.AsString()]; ok {
+				cs.LastSeen = stats.LastSeen
+				cs.Failures = stats.Failures
+			}
+			b.Contacts = append(b.Contacts, cs)
+		}
+		ret = append(ret, b)
+	}
+	return
+}
+
+// Every non-empty k-bucket, by increasing index.
+func (k *Kademlia) RoutingTableSnapshot() (ret []BucketSnapshot) {
+	resCh := make(chan []BucketSnapshot)
+	k.snapshotChannel <- routingRequest{k.NodeID, 0, resCh}
+	ret = <-resCh
+	close(resCh)
+	return
+}
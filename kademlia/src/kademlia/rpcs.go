@@ -9,17 +9,24 @@ import (
 	//	"fmt"
 	"net"
 	//	"strconv"
+	"time"
 )
 
 type KademliaCore struct {
 	kademlia *Kademlia
 }
 
-// Host identification.
+// Host identification. AltHosts holds the addresses of the node in the other
+// address families, on the same port. A node behind a NAT lists the nodes
+// relaying for it in Relays, or sets ClientOnly if it cannot be reached at
+// all.
 type Contact struct {
-	NodeID ID
-	Host   net.IP
-	Port   uint16
+	NodeID     ID
+	Host       net.IP
+	Port       uint16
+	AltHosts   []net.IP
+	Relays     []RelayAddr
+	ClientOnly bool
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -28,18 +35,24 @@ type Contact struct {
 type PingMessage struct {
 	Sender Contact
 	MsgID  ID
+	// set by the server codec, as for ReachabilityRequest
+	observed net.IP
 }
 
+// Observed is the address the ping came from as seen by the responder, which
+// lets the pinging node learn its external address.
 type PongMessage struct {
-	MsgID  ID
-	Sender Contact
+	MsgID    ID
+	Sender   Contact
+	Observed net.IP
 }
 
 func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
 	// TODO: Finish implementation
 	pong.MsgID = CopyID(ping.MsgID)
 	// Specify the sender
-	pong.Sender = kc.kademlia.SelfContact
+	pong.Sender = kc.kademlia.selfContact()
+	pong.Observed = ping.observed
 	// Update contact, etc
 	kc.kademlia.updateChannel <- ping.Sender
 	//fmt.Println("hehe: " + ping.Sender.Host.String() + ":" + strconv.Itoa(int(ping.Sender.Port)))
@@ -49,11 +62,20 @@ func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
 ///////////////////////////////////////////////////////////////////////////////
 // STORE
 ///////////////////////////////////////////////////////////////////////////////
+// In content-addressed mode, Key has to be the ContentID of Value. A value
+// older than Version is replaced, a newer one kept, but a value stored under
+// its ContentID is only ever replaced by the same content. Version is a time in
+// nanoseconds, and one more than maxVersionSkew ahead of the clock of the
+// receiver is refused, so that nobody can make a value impossible to replace.
 type StoreRequest struct {
-	Sender Contact
-	MsgID  ID
-	Key    ID
-	Value  []byte
+	Sender           Contact
+	MsgID            ID
+	Key              ID
+	Value            []byte
+	ContentAddressed bool
+	Version          int64
+	// how long the value is kept, forever if not positive
+	TTL time.Duration
 }
 
 type StoreResult struct {
@@ -65,16 +87,89 @@ func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
 	// TODO: Implement.
 	res.MsgID = req.MsgID
 	//fmt.Println("store: " + req.Key.AsString())
-	ok := kc.kademlia.storage.Put(req.Key, req.Value)
-	if ok {
-		res.Err = nil
-	} else {
-		res.Err = errors.New("Failed to store")
+	if req.ContentAddressed && !ContentID(req.Value).Equals(req.Key) {
+		return errors.New("Value does not match content key " + req.Key.AsString())
+	}
+	if _, ok := kc.kademlia.records.Get(req.Key); ok {
+		return errors.New("Key " + req.Key.AsString() + " holds a signed record")
+	}
+	if req.Version > time.Now().Add(maxVersionSkew).UnixNano() {
+		return errors.New("Version of " + req.Key.AsString() + " is in the future")
+	}
+	kc.kademlia.storeLock.Lock()
+	defer kc.kademlia.storeLock.Unlock()
+	if ival, found := kc.kademlia.storage.Get(req.Key); found {
+		old := ival.(StoredValue)
+		// a value stored under its content key can only be replaced by the
+		// same content, and replaces any other value whatever its version
+		oldContent := ContentID(old.Value).Equals(req.Key)
+		content := ContentID(req.Value).Equals(req.Key)
+		if oldContent && !content {
+			return errors.New("Key " + req.Key.AsString() + " holds a content-addressed value")
+		}
+		if oldContent == content && old.Version > req.Version {
+			return errors.New("A newer value is stored under " + req.Key.AsString())
+		}
+	}
+	val := StoredValue{Value: req.Value, Version: req.Version}
+	if req.TTL > 0 {
+		val.Expires = time.Now().Add(req.TTL)
 	}
 	kc.kademlia.updateChannel <- req.Sender
+	// gob cannot send an error in Err, so refusals are returned instead
+	if !kc.kademlia.storage.Put(req.Key, val) {
+		return errors.New("Failed to store")
+	}
 	return nil
 }
 
+///////////////////////////////////////////////////////////////////////////////
+// STORE_RECORD
+///////////////////////////////////////////////////////////////////////////////
+// Key has to be the RecordKey of the record's public key.
+type StoreRecordRequest struct {
+	Sender Contact
+	MsgID  ID
+	Key    ID
+	Record SignedRecord
+}
+
+type StoreRecordResult struct {
+	MsgID ID
+}
+
+func (kc *KademliaCore) StoreRecord(req StoreRecordRequest, res *StoreRecordResult) error {
+	res.MsgID = req.MsgID
+	kc.kademlia.updateChannel <- req.Sender
+	return kc.kademlia.records.Put(req.Key, &req.Record)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// APPEND
+///////////////////////////////////////////////////////////////////////////////
+// Adds Value to the set of values of Key on behalf of the sender, for TTL.
+type AppendRequest struct {
+	Sender Contact
+	MsgID  ID
+	Key    ID
+	Value  []byte
+	TTL    time.Duration
+}
+
+type AppendResult struct {
+	MsgID ID
+}
+
+func (kc *KademliaCore) Append(req AppendRequest, res *AppendResult) error {
+	res.MsgID = req.MsgID
+	ttl := req.TTL
+	if ttl <= 0 || ttl > MaxAppendTTL {
+		ttl = MaxAppendTTL
+	}
+	kc.kademlia.updateChannel <- req.Sender
+	return kc.kademlia.valueSets.Append(req.Key, req.Sender.NodeID, req.Value, ttl)
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // FIND_NODE
 ///////////////////////////////////////////////////////////////////////////////
@@ -104,29 +199,48 @@ func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error
 ///////////////////////////////////////////////////////////////////////////////
 // FIND_VALUE
 ///////////////////////////////////////////////////////////////////////////////
+// Offset is the index of the first value wanted from a key holding a set of
+// appended values.
 type FindValueRequest struct {
 	Sender Contact
 	MsgID  ID
 	Key    ID
+	Offset int
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
-// FindNodeResult.
+// FindNodeResult. A key holding appended values returns a page of them in
+// Values instead, Total being the number of values in the whole set, and a
+// key holding a signed record returns it in Record.
 type FindValueResult struct {
-	MsgID ID
-	Value []byte
-	Nodes []Contact
-	Err   error
+	MsgID   ID
+	Value   []byte
+	Nodes   []Contact
+	Err     error
+	Values  [][]byte
+	Total   int
+	Record  *SignedRecord
+	Version int64
+	// what is left of the TTL of Value, 0 if it has none
+	TTL time.Duration
 }
 
 func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) error {
 	// TODO: Implement.
 	res.MsgID = req.MsgID
 	ival, ok := kc.kademlia.storage.Get(req.Key)
-	if ok {
-		val := ival.([]byte)
-		res.Value = val
+	page, total := kc.kademlia.valueSets.GetPage(req.Key, req.Offset, valuesPerPage)
+	if record, found := kc.kademlia.records.Get(req.Key); found {
+		res.Record = record
+	} else if ok {
+		val := ival.(StoredValue)
+		res.Value = val.Value
+		res.Version = val.Version
+		res.TTL = val.ttl(time.Now())
 		res.Nodes = nil
+	} else if total > 0 {
+		res.Values = page
+		res.Total = total
 	} else {
 		res.Value = nil
 		res.Nodes = filterContactList(kc.kademlia.getLastContactFromRoutingTable(req.Key), req.Sender.NodeID)
@@ -153,13 +267,73 @@ func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) error {
 	res.MsgID = req.MsgID
 	// TODO: begin to work on VDO
 	ival, ok := kc.kademlia.vdoStorage.Get(req.VdoID)
-	if ok {
-		val := ival.(VanishingDataObject)
-		res.VDO = val
-		res.Err = nil
-	} else {
-		//res.VDO.Ciphertext = nil
-		res.Err = errors.New("VDO not found")
+	if !ok {
+		// gob cannot send an error in Err
+		return errors.New("VDO not found")
+	}
+	res.VDO = ival.(VanishingDataObject)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// REACHABILITY
+///////////////////////////////////////////////////////////////////////////////
+// Only the address the request came from is dialed back.
+type ReachabilityRequest struct {
+	Sender Contact
+	MsgID  ID
+	// set by the server codec, nil if the request was not made directly
+	observed net.IP
+}
+
+// Observed is the address the request came from, as for PongMessage.
+type ReachabilityResult struct {
+	MsgID     ID
+	Reachable bool
+	Observed  net.IP
+}
+
+func (kc *KademliaCore) CheckReachability(req ReachabilityRequest, res *ReachabilityResult) error {
+	res.MsgID = req.MsgID
+	res.Observed = req.observed
+	if req.observed == nil {
+		return errors.New("Reachability checks have to be made directly")
+	}
+	if !kc.kademlia.dialBacks.allow(req.observed, time.Now()) {
+		return errors.New("Too many reachability checks from " + req.observed.String())
+	}
+	// dial back directly, relays don't count
+	id, ok := kc.kademlia.internalPing(req.observed, req.Sender.Port, false)
+	res.Reachable = ok && id.Equals(req.Sender.NodeID)
+	// the sender is not added to the k-buckets, it may well be unreachable
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// RELAY_CONNECT
+///////////////////////////////////////////////////////////////////////////////
+// Sent by a relay over the control connection of a node it relays for: the
+// node has to dial back to the relay with Token.
+type RelayConnectRequest struct {
+	MsgID ID
+	Relay ID
+	Token string
+}
+
+type RelayConnectResult struct {
+	MsgID ID
+}
+
+func (kc *KademliaCore) RelayConnect(req RelayConnectRequest, res *RelayConnectResult) error {
+	res.MsgID = req.MsgID
+	relay, ok := kc.kademlia.findRelay(req.Relay)
+	if !ok {
+		return errors.New("Not relayed by " + req.Relay.AsString())
+	}
+	conn, err := dialConnect(JoinHostPort(relay.Host, relay.Port), relayBackPath+req.Token)
+	if err != nil {
+		return err
 	}
+	go kc.kademlia.server.ServeCodec(newObservingServerCodec(conn, nil, kc.kademlia))
 	return nil
 }
@@ -1,9 +1,44 @@
 package kademlia
 
 import (
+	"bytes"
+	"errors"
 	"sync"
+	"time"
 )
 
+const (
+	// how long an appended value lives when the publisher does not say
+	DefaultAppendTTL = 24 * time.Hour
+	MaxAppendTTL     = 24 * time.Hour
+	maxValuesPerKey  = 256
+	valuesPerPage    = 16
+	// how often expired values are deleted
+	expireInterval = time.Minute
+)
+
+// A plain value and its version, the time it was written at in nanoseconds,
+// so that replicas can tell which of their values is the newest. A value
+// stored with a TTL is deleted once Expires has passed, a zero Expires means
+// it is kept forever.
+type StoredValue struct {
+	Value   []byte
+	Version int64
+	Expires time.Time
+}
+
+func (v StoredValue) expired(now time.Time) bool {
+	return !v.Expires.IsZero() && !now.Before(v.Expires)
+}
+
+// What is left of the TTL of the value, 0 if it has none.
+func (v StoredValue) ttl(now time.Time) time.Duration {
+	if v.Expires.IsZero() {
+		return 0
+	}
+	return v.Expires.Sub(now)
+}
+
 type LocalStorage struct {
 	storage map[string]interface{}
 	lock    sync.Mutex
@@ -17,10 +52,27 @@ func NewLocalStorage() *LocalStorage {
 func (ls *LocalStorage) Get(key ID) (res interface{}, ok bool) {
 	ls.lock.Lock()
 	res, ok = ls.storage[key.AsString()]
+	if v, isValue := res.(StoredValue); isValue && v.expired(time.Now()) {
+		delete(ls.storage, key.AsString())
+		res, ok = nil, false
+	}
 	ls.lock.Unlock()
 	return
 }
 
+// Delete the values whose TTL is over.
+func (ls *LocalStorage) Expire(now time.Time) (deleted int) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	for key, val := range ls.storage {
+		if v, ok := val.(StoredValue); ok && v.expired(now) {
+			delete(ls.storage, key)
+			deleted++
+		}
+	}
+	return
+}
+
 func (ls *LocalStorage) Put(key ID, val interface{}) (ok bool) {
 	ok = true
 	ls.lock.Lock()
@@ -28,3 +80,116 @@ func (ls *LocalStorage) Put(key ID, val interface{}) (ok bool) {
 	ls.lock.Unlock()
 	return
 }
+
+// Number of keys stored and total size of the byte slice values.
+func (ls *LocalStorage) Stats() (keys int, bytes int) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	for _, val := range ls.storage {
+		if v, ok := val.(StoredValue); ok {
+			bytes += len(v.Value)
+		}
+	}
+	return len(ls.storage), bytes
+}
+
+// A value appended to a key by a publisher. It disappears once Expires has
+// passed unless the publisher appends it again.
+type appendedValue struct {
+	Publisher ID
+	Value     []byte
+	Expires   time.Time
+}
+
+// Keys holding a set of values from different publishers, each value with
+// its own TTL. Values are kept in the order they were first appended so that
+// pagination stays stable.
+type ValueSetStorage struct {
+	storage map[string][]appendedValue
+	lock    sync.Mutex
+}
+
+func NewValueSetStorage() *ValueSetStorage {
+	return &ValueSetStorage{storage: make(map[string][]appendedValue)}
+}
+
+// Must be called with the lock held.
+func (vs *ValueSetStorage) expire(key string, now time.Time) []appendedValue {
+	values := vs.storage[key]
+	kept := values[:0]
+	for _, v := range values {
+		if now.Before(v.Expires) {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		delete(vs.storage, key)
+		return nil
+	}
+	vs.storage[key] = kept
+	return kept
+}
+
+// Add value to the set of key, or refresh its TTL if publisher already
+// appended the same value.
+func (vs *ValueSetStorage) Append(key ID, publisher ID, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	values := vs.expire(key.AsString(), now)
+	for i, v := range values {
+		if v.Publisher.Equals(publisher) && bytes.Equal(v.Value, value) {
+			values[i].Expires = now.Add(ttl)
+			return nil
+		}
+	}
+	if len(values) >= maxValuesPerKey {
+		return errors.New("Too many values for key " + key.AsString())
+	}
+	vs.storage[key.AsString()] = append(values, appendedValue{publisher, value, now.Add(ttl)})
+	return nil
+}
+
+// Up to count values of key starting at offset, and the total number of
+// values it holds.
+func (vs *ValueSetStorage) GetPage(key ID, offset int, count int) (page [][]byte, total int) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	values := vs.expire(key.AsString(), time.Now())
+	total = len(values)
+	for i := offset; i >= 0 && i < total && len(page) < count; i++ {
+		page = append(page, values[i].Value)
+	}
+	return
+}
+
+func (vs *ValueSetStorage) Expire(now time.Time) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	for key := range vs.storage {
+		vs.expire(key, now)
+	}
+}
+
+func (vs *ValueSetStorage) Stats() (keys int, size int) {
+	now := time.Now()
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	for key := range vs.storage {
+		for _, v := range vs.expire(key, now) {
+			size += len(v.Value)
+		}
+	}
+	return len(vs.storage), size
+}
+
+// Delete expired values every expireInterval, so that they are gone from the
+// node and not only hidden from lookups.
+func (k *Kademlia) expireValues() {
+	for now := range time.Tick(expireInterval) {
+		if deleted := k.storage.Expire(now); deleted > 0 {
+			k.log.Debug("deleted expired values", "count", deleted)
+		}
+		k.valueSets.Expire(now)
+	}
+}
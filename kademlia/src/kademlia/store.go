@@ -0,0 +1,162 @@
+package kademlia
+
+// Contains the write path shared by every iterative store: the k closest
+// nodes to the key are sent their STORE (or APPEND, STORE_RECORD) in
+// parallel, and each acknowledgement or failure is accounted for so the
+// caller knows exactly where the value lives and whether the write quorum was
+// reached.
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how many STOREs a node has in flight at most
+const storeWorkers = 8
+
+type StoreFailure struct {
+	Contact Contact
+	Err     error
+}
+
+// The outcome of writing a key to its k closest nodes. Accepted and Failed are
+// sorted by distance to Key.
+type StoreReport struct {
+	Key      ID
+	Accepted []Contact
+	Failed   []StoreFailure
+	// how many nodes had to accept the value
+	Quorum int
+}
+
+func (r *StoreReport) QuorumMet() bool {
+	return len(r.Accepted) > 0 && len(r.Accepted) >= r.Quorum
+}
+
+func (r *StoreReport) String() string {
+	var buffer bytes.Buffer
+	if r.QuorumMet() {
+		buffer.WriteString("OK: ")
+	} else {
+		buffer.WriteString("ERR: Write quorum not reached, ")
+	}
+	buffer.WriteString("stored on " + strconv.Itoa(len(r.Accepted)) + " of " +
+		strconv.Itoa(len(r.Accepted)+len(r.Failed)) + " nodes (quorum " + strconv.Itoa(r.Quorum) + ")")
+	for idx, con := range r.Accepted {
+		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + con.NodeID.AsString() + " => " + JoinHostPort(con.Host, con.Port))
+	}
+	for _, f := range r.Failed {
+		buffer.WriteString("\nFAILED NodeID: " + f.Contact.NodeID.AsString() + " => " + f.Err.Error())
+	}
+	return buffer.String()
+}
+
+// A value to store under Key, kept by the nodes until Expires, or forever if
+// it is zero.
+type KeyValue struct {
+	Key     ID
+	Value   []byte
+	Expires time.Time
+}
+
+type storeJob struct {
+	con  *Contact
+	err  *error
+	done *sync.WaitGroup
+	run  func(con *Contact) error
+}
+
+// Write each key to its k closest nodes. Up to alpha lookups run at once and
+// feed their STOREs to a shared pool of storeWorkers, so that the stores of
+// one key overlap with the lookups of the next ones. store(idx, con) writes
+// keys[idx] to con.
+func (k *Kademlia) storeMany(keys []ID, store func(idx int, con *Contact) error) []*StoreReport {
+	jobs := make(chan storeJob)
+	for i := 0; i < storeWorkers; i++ {
+		go func() {
+			for job := range jobs {
+				*job.err = job.run(job.con)
+				job.done.Done()
+			}
+		}()
+	}
+	reports := make([]*StoreReport, len(keys))
+	lookups := make(chan bool, alpha)
+	var all sync.WaitGroup
+	for idx, key := range keys {
+		all.Add(1)
+		lookups <- true
+		go func(idx int, key ID) {
+			defer all.Done()
+			closest := k.internalIterative(key, false, false, nil).activeContactList
+			<-lookups
+			errs := make([]error, len(closest))
+			var done sync.WaitGroup
+			done.Add(len(closest))
+			for i := range closest {
+				jobs <- storeJob{&closest[i], &errs[i], &done, func(con *Contact) error {
+					return store(idx, con)
+				}}
+			}
+			done.Wait()
+			reports[idx] = k.storeReport(key, closest, errs)
+		}(idx, key)
+	}
+	all.Wait()
+	close(jobs)
+	return reports
+}
+
+func (k *Kademlia) storeReport(key ID, closest []Contact, errs []error) *StoreReport {
+	report := &StoreReport{Key: key, Quorum: k.WriteQuorum}
+	for idx, con := range closest {
+		if errs[idx] != nil {
+			report.Failed = append(report.Failed, StoreFailure{con, errs[idx]})
+		} else {
+			report.Accepted = append(report.Accepted, con)
+		}
+	}
+	if !report.QuorumMet() {
+		k.log.Warn("write quorum not reached", "key", key.AsString(),
+			"accepted", len(report.Accepted), "quorum", report.Quorum)
+	}
+	return report
+}
+
+// Run store on each of the k closest nodes to key and collect the
+// acknowledgements.
+func (k *Kademlia) storeOnClosest(key ID, store func(con *Contact) error) *StoreReport {
+	return k.storeMany([]ID{key}, func(idx int, con *Contact) error {
+		return store(con)
+	})[0]
+}
+
+// Store value on the k closest nodes to key, all replicas with the same
+// version.
+func (k *Kademlia) IterativeStore(key ID, value []byte) *StoreReport {
+	return k.IterativeStoreBatch([]KeyValue{{Key: key, Value: value}})[0]
+}
+
+// Same as IterativeStore for many pairs at once, sharing the lookups and
+// STOREs between them. The reports are in the order of items.
+func (k *Kademlia) IterativeStoreBatch(items []KeyValue) []*StoreReport {
+	version := time.Now().UnixNano()
+	keys := make([]ID, len(items))
+	for idx, item := range items {
+		keys[idx] = item.Key
+	}
+	return k.storeMany(keys, func(idx int, con *Contact) error {
+		// the TTL is counted from when the STORE is sent, the lookup may
+		// have taken a while
+		ttl := time.Duration(0)
+		if !items[idx].Expires.IsZero() {
+			if ttl = time.Until(items[idx].Expires); ttl <= 0 {
+				return errors.New("Value expired before it was stored")
+			}
+		}
+		return k.internalStore(con, items[idx].Key, items[idx].Value, version, ttl, false)
+	})
+}
@@ -0,0 +1,127 @@
+package kademlia
+
+// Contains the optional trace of an iterative lookup: every round, every
+// contact queried in it, how long it took to answer and what it returned, and
+// why the lookup stopped.
+
+import (
+	"bytes"
+	"container/heap"
+	"strconv"
+	"time"
+)
+
+const (
+	TerminatedEmptyTable = "empty routing table"
+	TerminatedValue      = "value found"
+	TerminatedKActive    = "k active contacts"
+	TerminatedExhausted  = "shortlist exhausted"
+	TerminatedNoProgress = "no closer contact found"
+)
+
+type TraceQuery struct {
+	Contact    Contact
+	Latency    time.Duration
+	Success    bool
+	FoundValue bool
+	Returned   []Contact
+}
+
+// Shortlist holds the contacts still waiting to be queried once the round is
+// over, closest first.
+type TraceRound struct {
+	Queries   []TraceQuery
+	Shortlist []Contact
+	// the final round queries every contact left instead of alpha of them
+	Final bool
+}
+
+type LookupTrace struct {
+	Key         ID
+	FindValue   bool
+	Start       time.Time
+	Duration    time.Duration
+	Rounds      []TraceRound
+	Termination string
+	Value       []byte
+	ValueFrom   Contact
+	Contacts    []Contact
+}
+
+func (t *LookupTrace) addRound(final bool, responses []iterativeResult, shortList *ContactHeap) {
+	round := TraceRound{Final: final}
+	for _, resp := range responses {
+		round.Queries = append(round.Queries, TraceQuery{
+			Contact:    resp.target,
+			Latency:    resp.latency,
+			Success:    resp.success,
+			FoundValue: resp.found(),
+			Returned:   resp.activeContactList,
+		})
+	}
+	round.Shortlist = sortedContacts(shortList.List, t.Key)
+	t.Rounds = append(t.Rounds, round)
+}
+
+// Sort a copy of the contacts by distance to key, closest first.
+func sortedContacts(input []Contact, key ID) (ret []Contact) {
+	cHeap := &ContactHeap{append([]Contact{}, input...), key}
+	heap.Init(cHeap)
+	ret = []Contact{}
+	for cHeap.Len() > 0 {
+		ret = append(ret, heap.Pop(cHeap).(Contact))
+	}
+	return
+}
+
+func (t *LookupTrace) String() string {
+	var buffer bytes.Buffer
+	kind := "find_node"
+	if t.FindValue {
+		kind = "find_value"
+	}
+	buffer.WriteString("Lookup (" + kind + ") of " + t.Key.AsString() + " took " + t.Duration.String() +
+		" in " + strconv.Itoa(len(t.Rounds)) + " rounds, terminated: " + t.Termination)
+	for idx, round := range t.Rounds {
+		buffer.WriteString("\nRound " + strconv.Itoa(idx+1))
+		if round.Final {
+			buffer.WriteString(" (final)")
+		}
+		buffer.WriteString(", " + strconv.Itoa(len(round.Shortlist)) + " contacts left in the shortlist")
+		for _, q := range round.Queries {
+			buffer.WriteString("\n  " + q.Contact.NodeID.AsString() + " => " + JoinHostPort(q.Contact.Host, q.Contact.Port) + " " + q.Latency.String())
+			switch {
+			case !q.Success:
+				buffer.WriteString(" FAILED")
+			case q.FoundValue:
+				buffer.WriteString(" returned the value")
+			default:
+				buffer.WriteString(" returned " + strconv.Itoa(len(q.Returned)) + " contacts")
+			}
+		}
+	}
+	if t.Value != nil {
+		buffer.WriteString("\nValue from " + t.ValueFrom.NodeID.AsString() + ": " + string(t.Value))
+	} else {
+		buffer.WriteString("\nClosest contacts:")
+		for idx, con := range t.Contacts {
+			buffer.WriteString("\n[" + strconv.Itoa(idx) + "] NodeID: " + con.NodeID.AsString() + " => " + JoinHostPort(con.Host, con.Port))
+		}
+	}
+	return buffer.String()
+}
+
+// Perform an iterative find node, or find value if findValue is set, and
+// return the trace of it.
+func (k *Kademlia) TraceLookup(key ID, findValue bool) *LookupTrace {
+	trace := &LookupTrace{Key: key, FindValue: findValue, Start: time.Now()}
+	resp := k.internalIterative(key, findValue, false, trace)
+	trace.Duration = time.Since(trace.Start)
+	if findValue && resp.value != nil {
+		trace.Value = resp.value
+		trace.ValueFrom = resp.target
+	} else {
+		trace.Contacts = resp.activeContactList
+	}
+	return trace
+}
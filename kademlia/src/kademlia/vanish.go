@@ -1,78 +1,206 @@
 package kademlia
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	mathrand "math/rand"
+	"sort"
 	"sss"
-	//	"strconv"
+	"strconv"
 	"time"
 )
 
 type VanishingDataObject struct {
-	AccessKey  int64
+	AccessKey  []byte
 	Ciphertext []byte
 	NumberKeys byte
 	Threshold  byte
+	// the epoch the shares were first pushed in
+	Epoch int64
+	// Unix time the shares are deleted at, and after which the VDO is not
+	// unvanished anymore
+	Expires int64
 }
 
-func GenerateRandomCryptoKey() (ret []byte) {
-	for i := 0; i < 32; i++ {
-		ret = append(ret, uint8(mathrand.Intn(256)))
+func (vdo VanishingDataObject) ExpiresAt() time.Time {
+	return time.Unix(vdo.Expires, 0)
+}
+
+// The Unix time of t rounded up to the second, so that a VDO stored with it
+// does not expire before t.
+func expiresUnix(t time.Time) int64 {
+	if t.Nanosecond() > 0 {
+		return t.Unix() + 1
 	}
-	return
+	return t.Unix()
 }
 
-func GenerateRandomAccessKey() (accessKey int64) {
-	r := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
-	accessKey = r.Int63()
-	return
+const (
+	CryptoKeySize = 32
+	AccessKeySize = 32
+	locationLabel = "vanish-location"
+)
+
+// crypto/rand never fails since Go 1.24, it aborts the program instead.
+func randomBytes(n int) []byte {
+	ret := make([]byte, n)
+	rand.Read(ret)
+	return ret
 }
 
-func CalculateSharedKeyLocations(accessKey int64, epoch int64, count int64) (ids []ID) {
-	r := mathrand.New(mathrand.NewSource(accessKey + epoch))
+func GenerateRandomCryptoKey() []byte {
+	return randomBytes(CryptoKeySize)
+}
+
+func GenerateRandomAccessKey() []byte {
+	return randomBytes(AccessKeySize)
+}
+
+// The i-th share of an epoch is stored under
+// HMAC-SHA256(accessKey, label || epoch || i) truncated to an ID, so the
+// locations can only be found with the access key.
+func CalculateSharedKeyLocations(accessKey []byte, epoch int64, count int64) (ids []ID) {
 	ids = make([]ID, count)
+	msg := make([]byte, len(locationLabel)+16)
+	copy(msg, locationLabel)
+	binary.BigEndian.PutUint64(msg[len(locationLabel):], uint64(epoch))
 	for i := int64(0); i < count; i++ {
-		for j := 0; j < IDBytes; j++ {
-			ids[i][j] = uint8(r.Intn(256))
-		}
+		binary.BigEndian.PutUint64(msg[len(locationLabel)+8:], uint64(i))
+		mac := hmac.New(sha256.New, accessKey)
+		mac.Write(msg)
+		copy(ids[i][:], mac.Sum(nil))
 	}
 	return
 }
 
-func encrypt(key []byte, text []byte) (ciphertext []byte) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		panic(err)
+// Each share is stored as index || share || tag, the tag being
+// HMAC-SHA256(shareMACKey, location || index || share). Only those holding
+// the access key can compute the MAC key, so a share altered by the node
+// storing it, or moved to another location, is detected before combining.
+const (
+	shareMACLabel = "vanish-share-mac"
+	shareTagSize  = sha256.Size
+)
+
+func shareMACKey(accessKey []byte) []byte {
+	mac := hmac.New(sha256.New, accessKey)
+	mac.Write([]byte(shareMACLabel))
+	return mac.Sum(nil)
+}
+
+func shareTag(macKey []byte, location ID, index byte, share []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(location[:])
+	mac.Write([]byte{index})
+	mac.Write(share)
+	return mac.Sum(nil)
+}
+
+func sealShare(macKey []byte, location ID, index byte, share []byte) []byte {
+	val := append([]byte{index}, share...)
+	return append(val, shareTag(macKey, location, index, share)...)
+}
+
+// The index and share in val if its tag is valid for location.
+func openShare(macKey []byte, location ID, val []byte) (index byte, share []byte, ok bool) {
+	if len(val) != 1+CryptoKeySize+shareTagSize {
+		return 0, nil, false
 	}
-	ciphertext = make([]byte, aes.BlockSize+len(text))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		panic(err)
+	index, share = val[0], val[1:1+CryptoKeySize]
+	if index == 0 || !hmac.Equal(val[1+CryptoKeySize:], shareTag(macKey, location, index, share)) {
+		return 0, nil, false
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], text)
-	return
+	return index, share, true
+}
+
+func accessKeyString(accessKey []byte) string {
+	return hex.EncodeToString(accessKey)
+}
+
+// Ciphertexts start with vdoMagic and a format version. Version 1 is AES-256
+// in GCM mode, the nonce following the header, authenticating the header and
+// the VDO parameters along with the data.
+const (
+	vdoMagic     = "VDO"
+	vdoVersion   = byte(1)
+	vdoHeaderLen = len(vdoMagic) + 1
+)
+
+var (
+	ErrVDOFormat  = errors.New("Not a VDO ciphertext or unsupported version")
+	ErrVDODecrypt = errors.New("Wrong key or tampered VDO")
+	// fewer than threshold shares could be found
+	ErrNotEnoughShares = errors.New("Not enough shares")
+	// the VDO is past its expiry time, or too few shares were found and the
+	// epoch it was created in is over
+	ErrVDOExpired = errors.New("VDO expired")
+	// fewer than threshold shares reached their write quorum
+	ErrSharesNotStored = errors.New("Could not store enough share keys")
+)
+
+// What the ciphertext is bound to besides its header, so that a VDO whose
+// parameters were altered fails to decrypt.
+func vdoAdditionalData(vdo VanishingDataObject) []byte {
+	ad := make([]byte, 0, len(vdo.AccessKey)+10)
+	ad = append(ad, vdo.AccessKey...)
+	ad = append(ad, vdo.NumberKeys, vdo.Threshold)
+	return binary.BigEndian.AppendUint64(ad, uint64(vdo.Expires))
+}
+
+func vdoAuthenticated(header []byte, ad []byte) []byte {
+	return append(append([]byte{}, header...), ad...)
 }
 
-func decrypt(key []byte, ciphertext []byte) (text []byte) {
+func newVDOCipher(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	if len(ciphertext) < aes.BlockSize {
-		panic("ciphertext is not long enough")
+	return cipher.NewGCM(block)
+}
+
+func encrypt(key []byte, text []byte, ad []byte) ([]byte, error) {
+	aead, err := newVDOCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(vdoMagic), vdoVersion)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
 	}
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	ciphertext := append(header, nonce...)
+	return aead.Seal(ciphertext, nonce, text, vdoAuthenticated(header, ad)), nil
+}
 
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
-	return ciphertext
+func decrypt(key []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	if len(ciphertext) < vdoHeaderLen || string(ciphertext[:len(vdoMagic)]) != vdoMagic ||
+		ciphertext[len(vdoMagic)] != vdoVersion {
+		return nil, ErrVDOFormat
+	}
+	aead, err := newVDOCipher(key)
+	if err != nil {
+		// sss.Combine on mismatching shares may not even give a key
+		return nil, ErrVDODecrypt
+	}
+	header := ciphertext[:vdoHeaderLen]
+	if len(ciphertext) < vdoHeaderLen+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrVDOFormat
+	}
+	nonce := ciphertext[vdoHeaderLen : vdoHeaderLen+aead.NonceSize()]
+	text, err := aead.Open(nil, nonce, ciphertext[vdoHeaderLen+aead.NonceSize():], vdoAuthenticated(header, ad))
+	if err != nil {
+		return nil, ErrVDODecrypt
+	}
+	return text, nil
 }
 
 // use for epoch re-push
@@ -80,120 +208,279 @@ const (
 	TimePeriod  = int64(3600)             // unit in hours
 	EpochCount  = int64(8)                // 8 hours per epoch
 	EpochPeriod = TimePeriod * EpochCount // seconds per epoch
+	// how long a VDO lives if not told, one epoch
+	DefaultVanishLifetime = time.Duration(EpochPeriod) * time.Second
 )
 
 func getCurrentEpoch() int64 {
 	return time.Now().Unix() / EpochPeriod
 }
 
-// push the shared keys to other nodes
-func pushShareKeys(kadem *Kademlia, vdo VanishingDataObject, key []byte) (success int) {
-	// how many shared keys are push to other nodes
-	success = 0
+// The outcome of pushing the shares of a VDO, one StoreReport per share in
+// the order of their locations.
+type VanishReport struct {
+	VDO    VanishingDataObject
+	Shares []*StoreReport
+	// how many shares reached their write quorum
+	Stored int
+}
 
-	// split the key
-	keyMap, err := sss.Split(vdo.NumberKeys, vdo.Threshold, key)
-	if err != nil {
-		err = errors.New("Error! Failed to split!")
-		fmt.Println(err.Error())
-		return
+func (r *VanishReport) Attempted() int {
+	return len(r.Shares)
+}
+
+// Whether enough shares were stored for the VDO to be unvanished.
+func (r *VanishReport) Succeeded() bool {
+	return r.Stored >= int(r.VDO.Threshold)
+}
+
+func (r *VanishReport) String() string {
+	var buffer bytes.Buffer
+	if r.Succeeded() {
+		buffer.WriteString("OK: ")
+	} else {
+		buffer.WriteString("ERR: " + ErrSharesNotStored.Error() + ", ")
 	}
-	// generate the shared keys locations using access key and epoch
-	ids := CalculateSharedKeyLocations(vdo.AccessKey, getCurrentEpoch(), int64(vdo.NumberKeys))
-	idx := 0
-	for k, v := range keyMap {
-		id := ids[idx]
-		val := append([]byte{k}, v...)
-		// TODO: call Kademlia's function to sprinkle the keys
-		// TODO: consider synchronized or asynchronized methods
-		_, cl := kadem.DoIterativeStore(id, val)
-		if cl != nil && len(cl) > 0 {
-			success++
+	buffer.WriteString("stored " + strconv.Itoa(r.Stored) + " of " + strconv.Itoa(r.Attempted()) +
+		" shares (threshold " + strconv.Itoa(int(r.VDO.Threshold)) + ")")
+	buffer.WriteString("\naccess key: " + accessKeyString(r.VDO.AccessKey))
+	buffer.WriteString("\nexpires: " + r.VDO.ExpiresAt().Format(time.RFC3339))
+	for idx, share := range r.Shares {
+		state := "stored"
+		if !share.QuorumMet() {
+			state = "FAILED"
 		}
-		idx += 1
+		buffer.WriteString("\n[" + strconv.Itoa(idx) + "] " + share.Key.AsString() + " " + state + " on " +
+			strconv.Itoa(len(share.Accepted)) + " of " + strconv.Itoa(len(share.Accepted)+len(share.Failed)) + " nodes")
 	}
-	return
+	return buffer.String()
 }
 
-// for EXTRA POINT: wait for re-pushing the shared keys
-func vdoMonitor(kadem *Kademlia, vdo VanishingDataObject, timeout int64) {
-	sec := timeout * TimePeriod
-	if sec > EpochPeriod {
-		sec = EpochPeriod
-	}
-	prepareSec := int64(1)
-	time.Sleep(time.Second * time.Duration(sec-prepareSec))
-	_, originKey := UnvanishData(kadem, vdo, false)
-	if originKey == nil {
-		fmt.Println("Failed to reconstruct the original key when extending time")
+// Split key and push the shares to the locations of epoch.
+func pushShareKeys(kadem *Kademlia, vdo VanishingDataObject, key []byte, epoch int64) (report VanishReport, err error) {
+	report.VDO = vdo
+	// split the key
+	keyMap, err := sss.Split(vdo.NumberKeys, vdo.Threshold, key)
+	if err != nil {
+		kadem.log.Error("failed to split the key", "err", err)
 		return
 	}
-	success := pushShareKeys(kadem, vdo, originKey)
-	if success < int(vdo.Threshold) {
-		fmt.Println("Failed to push share keys when extending time")
+	if !time.Now().Before(vdo.ExpiresAt()) {
+		err = ErrVDOExpired
 		return
 	}
-	timeout -= EpochCount
-	// to see if it is necessary to re-push the VDO again
-	if timeout > 0 {
-		go vdoMonitor(kadem, vdo, timeout)
+	// generate the shared keys locations using access key and epoch
+	ids := CalculateSharedKeyLocations(vdo.AccessKey, epoch, int64(vdo.NumberKeys))
+	macKey := shareMACKey(vdo.AccessKey)
+	items := []KeyValue{}
+	for k, v := range keyMap {
+		id := ids[len(items)]
+		items = append(items, KeyValue{id, sealShare(macKey, id, k, v), vdo.ExpiresAt()})
+	}
+	report.Shares = kadem.IterativeStoreBatch(items)
+	for _, share := range report.Shares {
+		if share.QuorumMet() {
+			report.Stored++
+		}
+		kadem.metrics.vdoPushed(share.QuorumMet())
+	}
+	if !report.Succeeded() {
+		err = ErrSharesNotStored
 	}
+	return
 }
 
+// Encrypt data and push the shares of its key, which the nodes delete once
+// lifetime is over, DefaultVanishLifetime if not positive. A VDO outliving
+// the current epoch needs its shares pushed again, see VDOManager.Schedule.
+// The report is returned along with ErrSharesNotStored when too few shares
+// were stored.
 func VanishData(kadem *Kademlia, data []byte, numberKeys byte,
-	threshold byte, timeout int64) (vdo VanishingDataObject, err error) {
-	err = nil
+	threshold byte, lifetime time.Duration) (report VanishReport, err error) {
+	if lifetime <= 0 {
+		lifetime = DefaultVanishLifetime
+	}
 	// generate key for encryption
 	key := GenerateRandomCryptoKey()
 
 	// generate VDO for return
+	vdo := VanishingDataObject{}
 	vdo.AccessKey = GenerateRandomAccessKey()
-	vdo.Ciphertext = encrypt(key, data)
 	vdo.NumberKeys = numberKeys
 	vdo.Threshold = threshold
+	vdo.Epoch = getCurrentEpoch()
+	vdo.Expires = expiresUnix(time.Now().Add(lifetime))
+	report.VDO = vdo
+	vdo.Ciphertext, err = encrypt(key, data, vdoAdditionalData(vdo))
+	if err != nil {
+		return
+	}
 
 	// push to other nodes
-	success := pushShareKeys(kadem, vdo, key)
+	return pushShareKeys(kadem, vdo, key, vdo.Epoch)
+}
+
+// how many share lookups run at once
+const shareWorkers = 8
 
-	if success < int(vdo.Threshold) {
-		err = errors.New("Could not store enough share keys")
-	} else if timeout > 0 && timeout*TimePeriod > EpochPeriod {
-		// TODO: start a new goroutine to extend tne timeout
-		go vdoMonitor(kadem, vdo, timeout)
+// The epochs whose share locations to probe, the most likely first: the one
+// the VDO was created in, then the current one where re-pushed shares are,
+// then its neighbors in case of clock skew. The shares of a VDO with an
+// expiry time are kept until then, so the epochs in between follow, the
+// latest first, in case the node pushing them again was down for a while.
+func probeEpochs(vdo VanishingDataObject, currentEpoch int64) []int64 {
+	epochs := []int64{}
+	if vdo.Epoch <= currentEpoch+1 && (vdo.Epoch >= currentEpoch-1 || vdo.Expires != 0) {
+		epochs = append(epochs, vdo.Epoch)
 	}
-	return
+	for _, epoch := range []int64{currentEpoch, currentEpoch - 1, currentEpoch + 1} {
+		if epoch != vdo.Epoch || len(epochs) == 0 {
+			epochs = append(epochs, epoch)
+		}
+	}
+	if vdo.Expires != 0 {
+		for epoch := currentEpoch - 2; epoch > vdo.Epoch; epoch-- {
+			epochs = append(epochs, epoch)
+		}
+	}
+	return epochs
+}
+
+type shareReply struct {
+	location ID
+	value    []byte
+}
+
+// Look up the shares stored at ids, shareWorkers at a time, adding the valid
+// ones to keyMap until it holds threshold of them. The lookups still in flight
+// then are not waited for; the locations not looked up are returned.
+func fetchShares(kadem *Kademlia, ids []ID, macKey []byte, threshold int, keyMap map[byte][]byte) (unfetched []ID) {
+	results := make(chan shareReply, len(ids))
+	done := make(map[ID]bool)
+	next, pending := 0, 0
+	for len(keyMap) < threshold && (next < len(ids) || pending > 0) {
+		for ; next < len(ids) && pending < shareWorkers; next++ {
+			pending++
+			go func(id ID) {
+				_, val, _ := kadem.DoIterativeFindValue(id)
+				results <- shareReply{id, val}
+			}(ids[next])
+		}
+		reply := <-results
+		pending--
+		done[reply.location] = true
+		if reply.value == nil {
+			continue
+		}
+		index, share, ok := openShare(macKey, reply.location, reply.value)
+		if !ok {
+			kadem.log.Warn("discarding invalid share", "location", reply.location.AsString())
+			continue
+		}
+		keyMap[index] = share
+	}
+	for _, id := range ids {
+		if !done[id] {
+			unfetched = append(unfetched, id)
+		}
+	}
+	return unfetched
+}
+
+// at most how many subsets of the shares are combined
+const maxCombineAttempts = 64
+
+// Combine the shares into a key that decrypts the VDO: all of them first,
+// then subsets of threshold of them, in case some valid shares are from
+// another VDO using the same access key.
+func combineShares(vdo VanishingDataObject, keyMap map[byte][]byte) (key []byte, plain []byte, err error) {
+	key = sss.Combine(keyMap)
+	if plain, err = decrypt(key, vdo.Ciphertext, vdoAdditionalData(vdo)); err != ErrVDODecrypt {
+		return
+	}
+	indexes := []byte{}
+	for index := range keyMap {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	t := int(vdo.Threshold)
+	if t >= len(indexes) {
+		return nil, nil, err
+	}
+	// pick holds the positions in indexes of the current subset
+	pick := make([]int, t)
+	for i := range pick {
+		pick[i] = i
+	}
+	for attempt := 0; attempt < maxCombineAttempts; attempt++ {
+		subset := make(map[byte][]byte, t)
+		for _, p := range pick {
+			subset[indexes[p]] = keyMap[indexes[p]]
+		}
+		key = sss.Combine(subset)
+		if plain, err = decrypt(key, vdo.Ciphertext, vdoAdditionalData(vdo)); err != ErrVDODecrypt {
+			return
+		}
+		// next subset in lexicographic order
+		i := t - 1
+		for i >= 0 && pick[i] == len(indexes)-t+i {
+			i--
+		}
+		if i < 0 {
+			break
+		}
+		pick[i]++
+		for j := i + 1; j < t; j++ {
+			pick[j] = pick[j-1] + 1
+		}
+	}
+	return nil, nil, err
 }
 
-func UnvanishData(kadem *Kademlia, vdo VanishingDataObject, doDecrypt bool) (data []byte, key []byte) {
-	data = nil
-	key = nil
+// Collect the shares of the VDO key and check the key against the
+// ciphertext. The data is only returned if doDecrypt is set. Refuses a VDO
+// past its expiry time with ErrVDOExpired. Fails with ErrVDODecrypt if enough
+// shares were found but do not decrypt the VDO, otherwise with ErrVDOExpired
+// or ErrNotEnoughShares.
+func UnvanishData(kadem *Kademlia, vdo VanishingDataObject, doDecrypt bool) (data []byte, key []byte, err error) {
+	if vdo.Expires != 0 && !time.Now().Before(vdo.ExpiresAt()) {
+		return nil, nil, fmt.Errorf("%w at %s", ErrVDOExpired, vdo.ExpiresAt().UTC().Format(time.RFC3339))
+	}
 	currentEpoch := getCurrentEpoch()
-	var success = 0
-	// use the current and the neighbor epoch to find the keys
-	for epoch := int64(-1); epoch <= 1; epoch++ {
-		ids := CalculateSharedKeyLocations(vdo.AccessKey, currentEpoch+epoch, int64(vdo.NumberKeys))
+	macKey := shareMACKey(vdo.AccessKey)
+	found := 0
+	for _, epoch := range probeEpochs(vdo, currentEpoch) {
+		ids := CalculateSharedKeyLocations(vdo.AccessKey, epoch, int64(vdo.NumberKeys))
 		keyMap := make(map[byte][]byte)
-		success = 0
-		for _, id := range ids {
-			// TODO: collect the shared keys
-			// TODO: consider the synchronized and asynchronized methods
-			_, val, _ := kadem.DoIterativeFindValue(id)
-			if val != nil {
-				k := val[0]
-				v := val[1:]
-				keyMap[k] = v
-				success++
-			}
-		}
-		if success >= int(vdo.Threshold) {
-			key = sss.Combine(keyMap)
-			break
+		unfetched := fetchShares(kadem, ids, macKey, int(vdo.Threshold), keyMap)
+		if len(keyMap) > found {
+			found = len(keyMap)
+		}
+		if len(keyMap) < int(vdo.Threshold) {
+			continue
+		}
+		candidate, plain, decErr := combineShares(vdo, keyMap)
+		if decErr == ErrVDODecrypt && len(unfetched) > 0 {
+			// try again with the shares not looked up yet
+			fetchShares(kadem, unfetched, macKey, len(ids), keyMap)
+			candidate, plain, decErr = combineShares(vdo, keyMap)
+		}
+		if decErr != nil {
+			err = decErr
+			continue
 		}
+		key = candidate
+		if doDecrypt {
+			data = plain
+		}
+		return data, key, nil
 	}
-	// if the number of successfully collected keys >= threshold
-	// then we could decrypt the ciphertext
-	if success >= int(vdo.Threshold) && doDecrypt {
-		data = decrypt(key, vdo.Ciphertext)
+	if err == nil {
+		reason := ErrNotEnoughShares
+		if vdo.Epoch < currentEpoch-1 {
+			reason = ErrVDOExpired
+		}
+		err = fmt.Errorf("%w: found %d of %d shares", reason, found, vdo.Threshold)
 	}
-	return
+	return nil, nil, err
 }
@@ -0,0 +1,109 @@
+package kademlia
+
+// Contains the portable encoding of a VDO, so that it can be handed to
+// someone as a file or a string instead of living only in a node's
+// vdoStorage. The binary form is, all integers big-endian:
+//
+//	"KVDO" version(1)
+//	cipher(1) locations(1) sharing(1)
+//	N(1) threshold(1) epoch(8) epoch period in seconds(8)
+//	expiry Unix time(8)
+//	access key length(2) access key
+//	ciphertext length(4) ciphertext
+//
+// The text form is the binary one in a PEM block of type VDOArmorType.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"strconv"
+)
+
+const (
+	vdoFileMagic   = "KVDO"
+	vdoFileVersion = byte(2)
+	VDOArmorType   = "VANISH VDO"
+
+	// algorithm identifiers, shares are authenticated since sharing 2
+	vdoCipherAESGCM      = byte(1)
+	vdoLocationsHMAC     = byte(1)
+	vdoSharingShamirMAC  = byte(2)
+	vdoFixedHeaderLength = len(vdoFileMagic) + 1 + 3 + 2 + 24
+)
+
+func EncodeVDO(vdo VanishingDataObject) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(vdoFileMagic)
+	buffer.Write([]byte{vdoFileVersion, vdoCipherAESGCM, vdoLocationsHMAC, vdoSharingShamirMAC,
+		vdo.NumberKeys, vdo.Threshold})
+	binary.Write(&buffer, binary.BigEndian, vdo.Epoch)
+	binary.Write(&buffer, binary.BigEndian, EpochPeriod)
+	binary.Write(&buffer, binary.BigEndian, vdo.Expires)
+	binary.Write(&buffer, binary.BigEndian, uint16(len(vdo.AccessKey)))
+	buffer.Write(vdo.AccessKey)
+	binary.Write(&buffer, binary.BigEndian, uint32(len(vdo.Ciphertext)))
+	buffer.Write(vdo.Ciphertext)
+	return buffer.Bytes()
+}
+
+func DecodeVDO(data []byte) (vdo VanishingDataObject, err error) {
+	if len(data) < vdoFixedHeaderLength || string(data[:len(vdoFileMagic)]) != vdoFileMagic {
+		return vdo, errors.New("Not a VDO")
+	}
+	data = data[len(vdoFileMagic):]
+	if data[0] != vdoFileVersion {
+		return vdo, errors.New("Unsupported VDO version " + strconv.Itoa(int(data[0])))
+	}
+	if data[1] != vdoCipherAESGCM || data[2] != vdoLocationsHMAC || data[3] != vdoSharingShamirMAC {
+		return vdo, errors.New("Unsupported VDO algorithms")
+	}
+	vdo.NumberKeys, vdo.Threshold = data[4], data[5]
+	if vdo.Threshold == 0 || vdo.Threshold > vdo.NumberKeys {
+		return vdo, errors.New("Invalid VDO threshold")
+	}
+	vdo.Epoch = int64(binary.BigEndian.Uint64(data[6:]))
+	if period := int64(binary.BigEndian.Uint64(data[14:])); period != EpochPeriod {
+		return vdo, errors.New("Unsupported VDO epoch period " + strconv.FormatInt(period, 10))
+	}
+	vdo.Expires = int64(binary.BigEndian.Uint64(data[22:]))
+	data = data[30:]
+	if len(data) < 2 {
+		return vdo, errors.New("Truncated VDO")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if n == 0 || len(data) < n+4 {
+		return vdo, errors.New("Truncated VDO")
+	}
+	vdo.AccessKey = append([]byte{}, data[:n]...)
+	data = data[n:]
+	n = int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if len(data) != n {
+		return vdo, errors.New("Truncated VDO")
+	}
+	vdo.Ciphertext = append([]byte{}, data...)
+	return vdo, nil
+}
+
+func ArmorVDO(vdo VanishingDataObject) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    VDOArmorType,
+		Headers: map[string]string{"Version": strconv.Itoa(int(vdoFileVersion))},
+		Bytes:   EncodeVDO(vdo),
+	})
+}
+
+// Decode a VDO in either form.
+func ParseVDO(data []byte) (VanishingDataObject, error) {
+	if bytes.HasPrefix(data, []byte(vdoFileMagic)) {
+		return DecodeVDO(data)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != VDOArmorType {
+		return VanishingDataObject{}, errors.New("Not a VDO")
+	}
+	return DecodeVDO(block.Bytes)
+}
@@ -0,0 +1,278 @@
+package kademlia
+
+// Contains the VDO lifecycle manager. A VDO living longer than the epoch it
+// was created in has its shares pushed again at the start of every epoch
+// until it expires. The schedule is kept in memory and, once a state file is
+// set, saved to it on every change and resumed from it at startup, so a
+// restarted node does not let its VDOs vanish early.
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how long to wait before pushing again the shares of a VDO that failed to be
+// pushed
+const vdoRetryInterval = 5 * time.Minute
+
+// A VDO whose shares are pushed again until it expires. LastErr and Failures
+// report the re-pushes that failed since the last successful one.
+type ScheduledVDO struct {
+	VdoID    ID
+	VDO      VanishingDataObject
+	NextPush time.Time
+	LastPush time.Time
+	LastErr  string
+	Failures int
+}
+
+// as saved in the state file, the VDO in its portable encoding
+type scheduledVDOState struct {
+	VdoID    string    `json:"vdo_id"`
+	VDO      []byte    `json:"vdo"`
+	NextPush time.Time `json:"next_push"`
+	LastPush time.Time `json:"last_push,omitempty"`
+	LastErr  string    `json:"last_error,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+}
+
+type VDOManager struct {
+	kadem *Kademlia
+	// the state file, none if empty
+	path      string
+	scheduled map[string]*ScheduledVDO
+	lock      sync.Mutex
+	// wakes the scheduler up when the schedule changed
+	wake chan bool
+}
+
+func NewVDOManager(kadem *Kademlia) *VDOManager {
+	return &VDOManager{kadem: kadem, scheduled: make(map[string]*ScheduledVDO), wake: make(chan bool, 1)}
+}
+
+// The start of the epoch after the current one, if the VDO lives until then.
+func nextPush(vdo VanishingDataObject, now time.Time) (time.Time, bool) {
+	next := time.Unix((now.Unix()/EpochPeriod+1)*EpochPeriod, 0)
+	return next, next.Before(vdo.ExpiresAt())
+}
+
+func (m *VDOManager) notify() {
+	select {
+	case m.wake <- true:
+	default:
+	}
+}
+
+// Must be called with the lock held.
+func (m *VDOManager) save() error {
+	if m.path == "" {
+		return nil
+	}
+	states := []scheduledVDOState{}
+	for _, s := range m.scheduled {
+		states = append(states, scheduledVDOState{s.VdoID.AsString(), EncodeVDO(s.VDO), s.NextPush,
+			s.LastPush, s.LastErr, s.Failures})
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file holds access keys, and is replaced at once so that a crash
+	// does not leave half of it
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func (m *VDOManager) saveOrLog() {
+	if err := m.save(); err != nil {
+		m.kadem.log.Error("failed to save the VDO schedule", "path", m.path, "err", err)
+	}
+}
+
+// Use path as the state file, resuming the VDOs it lists if it exists. They
+// are added to the VDOs of the node, and those whose re-push was missed while
+// the node was down are pushed right away.
+func (m *VDOManager) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	states := []scheduledVDOState{}
+	if err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			return errors.New("Invalid VDO schedule " + path + ": " + err.Error())
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.path = path
+	now := time.Now()
+	for _, st := range states {
+		vdoID, err := IDFromString(st.VdoID)
+		if err != nil {
+			return errors.New("Invalid VDO ID in " + path + ": " + st.VdoID)
+		}
+		vdo, err := DecodeVDO(st.VDO)
+		if err != nil {
+			return errors.New("Invalid VDO " + st.VdoID + " in " + path + ": " + err.Error())
+		}
+		if !now.Before(vdo.ExpiresAt()) {
+			continue
+		}
+		m.kadem.vdoStorage.Put(vdoID, vdo)
+		m.scheduled[vdoID.AsString()] = &ScheduledVDO{vdoID, vdo, st.NextPush, st.LastPush, st.LastErr, st.Failures}
+	}
+	m.kadem.log.Info("VDO schedule loaded", "path", path, "vdos", len(m.scheduled))
+	m.notify()
+	return m.save()
+}
+
+// Push the shares of vdo again at every epoch until it expires. Does nothing
+// if it expires within the current epoch.
+func (m *VDOManager) Schedule(vdoID ID, vdo VanishingDataObject) {
+	next, ok := nextPush(vdo, time.Now())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !ok {
+		delete(m.scheduled, vdoID.AsString())
+	} else {
+		m.scheduled[vdoID.AsString()] = &ScheduledVDO{VdoID: vdoID, VDO: vdo, NextPush: next}
+	}
+	m.saveOrLog()
+	m.notify()
+}
+
+// Stop pushing the shares of the VDO, which then vanishes once its shares
+// can no longer be found.
+func (m *VDOManager) Cancel(vdoID ID) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.scheduled[vdoID.AsString()]; !ok {
+		return false
+	}
+	delete(m.scheduled, vdoID.AsString())
+	m.saveOrLog()
+	m.notify()
+	return true
+}
+
+// The VDOs scheduled, the next one to push first.
+func (m *VDOManager) List() []ScheduledVDO {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := []ScheduledVDO{}
+	for _, s := range m.scheduled {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].NextPush.Before(ret[j].NextPush) })
+	return ret
+}
+
+// Reconstruct the key of the VDO and push its shares for the current epoch.
+func (m *VDOManager) push(vdo VanishingDataObject) error {
+	_, key, err := UnvanishData(m.kadem, vdo, false)
+	if err != nil {
+		return errors.New("Could not reconstruct the key: " + err.Error())
+	}
+	_, err = pushShareKeys(m.kadem, vdo, key, getCurrentEpoch())
+	return err
+}
+
+// Push the shares of the VDOs when they are due, forever.
+func (m *VDOManager) run() {
+	for {
+		var due []ScheduledVDO
+		wait := time.Duration(-1)
+		now := time.Now()
+		m.lock.Lock()
+		for key, s := range m.scheduled {
+			if !now.Before(s.VDO.ExpiresAt()) {
+				delete(m.scheduled, key)
+				continue
+			}
+			if !now.Before(s.NextPush) {
+				due = append(due, *s)
+			} else if wait < 0 || s.NextPush.Sub(now) < wait {
+				wait = s.NextPush.Sub(now)
+			}
+		}
+		m.lock.Unlock()
+
+		for _, s := range due {
+			m.pushDue(s)
+		}
+		if len(due) > 0 {
+			continue
+		}
+		var timer <-chan time.Time
+		if wait >= 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-timer:
+		case <-m.wake:
+		}
+	}
+}
+
+func (m *VDOManager) pushDue(s ScheduledVDO) {
+	err := m.push(s.VDO)
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cur, ok := m.scheduled[s.VdoID.AsString()]
+	if !ok || !cur.NextPush.Equal(s.NextPush) || !cur.VDO.ExpiresAt().Equal(s.VDO.ExpiresAt()) {
+		// cancelled or changed while we were pushing
+		return
+	}
+	if err != nil {
+		cur.LastErr = err.Error()
+		cur.Failures++
+		cur.NextPush = now.Add(vdoRetryInterval)
+		m.kadem.log.Warn("VDO re-push failed", "vdo_id", s.VdoID.AsString(), "failures", cur.Failures, "err", err)
+	} else {
+		cur.LastPush = now
+		cur.LastErr = ""
+		cur.Failures = 0
+		next, more := nextPush(cur.VDO, now)
+		if !more {
+			delete(m.scheduled, s.VdoID.AsString())
+		}
+		cur.NextPush = next
+		m.kadem.log.Info("share keys pushed again", "vdo_id", s.VdoID.AsString(), "expires", cur.VDO.ExpiresAt())
+	}
+	m.saveOrLog()
+}
+
+// Make the VDO stored under vdoID expire by more later. Its ciphertext is
+// bound to its expiry time, so it is encrypted again under the same key, and
+// the shares are pushed again with the new TTL. Copies of the VDO handed out
+// before keep their expiry time.
+func (m *VDOManager) Extend(vdoID ID, by time.Duration) (VanishingDataObject, error) {
+	ival, ok := m.kadem.vdoStorage.Get(vdoID)
+	if !ok {
+		return VanishingDataObject{}, errors.New("No VDO stored under " + vdoID.AsString())
+	}
+	vdo := ival.(VanishingDataObject)
+	data, key, err := UnvanishData(m.kadem, vdo, true)
+	if err != nil {
+		return vdo, err
+	}
+	vdo.Expires = expiresUnix(vdo.ExpiresAt().Add(by))
+	if vdo.Ciphertext, err = encrypt(key, data, vdoAdditionalData(vdo)); err != nil {
+		return vdo, err
+	}
+	if _, err := pushShareKeys(m.kadem, vdo, key, getCurrentEpoch()); err != nil {
+		return vdo, err
+	}
+	m.kadem.vdoStorage.Put(vdoID, vdo)
+	m.Schedule(vdoID, vdo)
+	return vdo, nil
+}
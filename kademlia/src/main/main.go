@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/rpc"
@@ -15,6 +17,7 @@ import (
 )
 
 import (
+	"admin"
 	"kademlia"
 )
 
@@ -24,6 +27,16 @@ func main() {
 	// random numbers
 	rand.Seed(time.Now().UnixNano())
 
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	adminAddr := flag.String("admin", "", "serve the admin HTTP API on this host:port")
+	adminToken := flag.String("admin-token", os.Getenv("KADEMLIA_ADMIN_TOKEN"),
+		"token the admin API requires, defaults to $KADEMLIA_ADMIN_TOKEN")
+	adminCert := flag.String("admin-cert", "", "serve the admin API over TLS with this certificate file")
+	adminKey := flag.String("admin-key", "", "private key file of -admin-cert")
+	writeQuorum := flag.Int("write-quorum", 1, "nodes that must accept a value for an iterative store to succeed")
+	readQuorum := flag.Int("read-quorum", 1, "replicas that must agree on the newest value iterativeFindValue returns")
+	vdoState := flag.String("vdo-state", "", "save the VDO re-push schedule to this file and resume it at startup")
+
 	// Get the bind and connect connection strings from command-line arguments.
 	flag.Parse()
 	args := flag.Args()
@@ -33,9 +46,36 @@ func main() {
 	listenStr := args[0]
 	firstPeerStr := args[1]
 
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatal("Invalid log level: ", *logLevel)
+	}
+	logger := kademlia.NewLogger(os.Stderr, level)
+
 	// Create the Kademlia instance
 	fmt.Printf("kademlia starting up!\n")
-	kadem := kademlia.NewKademlia(listenStr, nil)
+	kadem, err := kademlia.NewKademliaWithLogger(listenStr, nil, logger)
+	if err != nil {
+		log.Fatal("NewKademlia: ", err)
+	}
+	if *readQuorum < 1 || *readQuorum > kademlia.K {
+		log.Fatal("The read quorum must be between 1 and ", kademlia.K)
+	}
+	kadem.ReadQuorum = *readQuorum
+	if *writeQuorum < 1 || *writeQuorum > kademlia.K {
+		log.Fatal("The write quorum must be between 1 and ", kademlia.K)
+	}
+	kadem.WriteQuorum = *writeQuorum
+	if *adminAddr != "" {
+		if *adminToken == "" {
+			log.Fatal("The admin API requires a token, see -admin-token")
+		}
+		go func() {
+			err := admin.ListenAndServe(*adminAddr, kadem, *adminToken, *adminCert, *adminKey)
+			log.Fatal("Admin API: ", err)
+		}()
+		logger.Info("admin API listening", "addr", *adminAddr)
+	}
 
 	// Confirm our server is up with a PING request and then exit.
 	// Your code should loop forever, reading instructions from stdin and
@@ -48,7 +88,7 @@ func main() {
 	}
 
 	ping := new(kademlia.PingMessage)
-	ping.Sender = kadem.SelfContact
+	ping.Sender = kadem.Self()
 	ping.MsgID = kademlia.NewRandomID()
 	var pong kademlia.PongMessage
 	err = client.Call("KademliaCore.Ping", ping, &pong)
@@ -57,8 +97,14 @@ func main() {
 		log.Fatal("Call: ", err)
 	}
 	kadem.AddContact(pong.Sender)
-	log.Printf("ping msgID: %s\n", ping.MsgID.AsString())
-	log.Printf("pong msgID: %s\n", pong.MsgID.AsString())
+	logger.Info("bootstrap ping answered", "peer", pong.Sender.NodeID.AsString(),
+		"msg_id", ping.MsgID.AsString(), "pong_msg_id", pong.MsgID.AsString())
+	// resumed once the node is in the network, missed re-pushes run at once
+	if *vdoState != "" {
+		if err := kadem.LoadVDOSchedule(*vdoState); err != nil {
+			log.Fatal("VDO schedule: ", err)
+		}
+	}
 
 	in := bufio.NewReader(os.Stdin)
 	quit := false
@@ -81,6 +127,27 @@ func main() {
 	}
 }
 
+func formatRoutingTable(buckets []kademlia.BucketSnapshot) string {
+	if len(buckets) == 0 {
+		return "OK: routing table is empty"
+	}
+	now := time.Now()
+	response := "OK:"
+	for _, b := range buckets {
+		response += fmt.Sprintf("\nbucket %d (%d contacts)", b.Index, len(b.Contacts))
+		for _, c := range b.Contacts {
+			seen := "never"
+			if !c.LastSeen.IsZero() {
+				seen = now.Sub(c.LastSeen).Truncate(time.Second).String() + " ago"
+			}
+			response += fmt.Sprintf("\n  %s %s last seen %s, %d failures",
+				c.Contact.NodeID.AsString(), kademlia.JoinHostPort(c.Contact.Host, c.Contact.Port),
+				seen, c.Failures)
+		}
+	}
+	return response
+}
+
 func executeLine(k *kademlia.Kademlia, line string) (response string) {
 	toks := strings.Fields(line)
 	switch {
@@ -110,7 +177,29 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		response = "OK: NodeID=" + toks[1] + "\n"
 		response += "      Host=" + c.Host.String() + "\n"
+		for _, alt := range c.AltHosts {
+			response += "      Host=" + alt.String() + "\n"
+		}
 		response += "      Port=" + strconv.Itoa(int(c.Port))
+
+	case toks[0] == "routing_table":
+		// list the non-empty k-buckets, least recently seen contact first
+		if len(toks) > 2 || (len(toks) == 2 && toks[1] != "json") {
+			response = "usage: routing_table [json]"
+			return
+		}
+		buckets := k.RoutingTableSnapshot()
+		if len(toks) == 2 {
+			out, err := json.MarshalIndent(buckets, "", "  ")
+			if err != nil {
+				response = "ERR: " + err.Error()
+				return
+			}
+			response = string(out)
+			return
+		}
+		response = formatRoutingTable(buckets)
+
 	case toks[0] == "ping":
 		// Do a ping
 		//
@@ -125,29 +214,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		id, err := kademlia.IDFromString(toks[1])
 		if err != nil {
-			hostname, portstr, err := net.SplitHostPort(toks[1])
+			host, port, err := kademlia.ParseHostPort(toks[1])
 			if err != nil {
 				response = "ERR: Not a valid Node ID or host:port address"
 				return
 			}
-			port, err := strconv.Atoi(portstr)
-			if err != nil {
-				response = "ERR: Not a valid Node ID or host:port address"
-				return
-			}
-			ipAddrStrings, err := net.LookupHost(hostname)
-			if err != nil {
-				response = "ERR: Could not find the provided hostname"
-				return
-			}
-			var host net.IP
-			for i := 0; i < len(ipAddrStrings); i++ {
-				host = net.ParseIP(ipAddrStrings[i])
-				if host.To4() != nil {
-					break
-				}
-			}
-			response = k.DoPing(host, uint16(port))
+			response = k.DoPing(host, port)
 			return
 		}
 		c, err := k.FindContact(id)
@@ -157,6 +229,15 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		response = k.DoPing(c.Host, c.Port)
 
+	case toks[0] == "nat_check":
+		// find out if other nodes can dial us, and register with a relay if
+		// they cannot
+		if len(toks) != 1 {
+			response = "usage: nat_check"
+			return
+		}
+		response = k.DoNATCheck()
+
 	case toks[0] == "local_find_value":
 		// print a local variable
 		if len(toks) < 2 || len(toks) > 2 {
@@ -269,10 +350,45 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		response, _ = k.DoIterativeStore(key, []byte(toks[2]))
 
+	case toks[0] == "iterativeAppend":
+		// add a value to the set of values of a key
+		if len(toks) != 3 && len(toks) != 4 {
+			response = "usage: iterativeAppend [key] [value] [ttl seconds(optional)]"
+			return
+		}
+		key, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		ttl := kademlia.DefaultAppendTTL
+		if len(toks) == 4 {
+			seconds, err := strconv.Atoi(toks[3])
+			if err != nil || seconds <= 0 {
+				response = "ERR: Provided an invalid TTL (" + toks[3] + ")"
+				return
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+		response, _ = k.DoIterativeAppend(key, []byte(toks[2]), ttl)
+
+	case toks[0] == "iterativeFindValues":
+		// list every value appended to a key
+		if len(toks) != 2 {
+			response = "usage: iterativeFindValues [key]"
+			return
+		}
+		key, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		response, _ = k.DoIterativeFindValues(key)
+
 	case toks[0] == "iterativeFindValue":
 		// performa an iterative find value
-		if len(toks) != 2 {
-			response = "usage: iterativeFindValue [key]"
+		if len(toks) != 2 && len(toks) != 3 {
+			response = "usage: iterativeFindValue [key] [read quorum(optional)]"
 			return
 		}
 		key, err := kademlia.IDFromString(toks[1])
@@ -280,8 +396,105 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[1] + ")"
 			return
 		}
+		if len(toks) == 3 {
+			quorum, err := strconv.Atoi(toks[2])
+			if err != nil || quorum < 1 || quorum > kademlia.K {
+				response = "ERR: Provided an invalid read quorum (" + toks[2] + ")"
+				return
+			}
+			response, _, _ = k.DoQuorumFindValue(key, quorum)
+			return
+		}
 		response, _, _ = k.DoIterativeFindValue(key)
 
+	case toks[0] == "iterativeStoreContent":
+		// store a value under its hash, printing the key
+		if len(toks) != 2 {
+			response = "usage: iterativeStoreContent [value]"
+			return
+		}
+		response, _, _ = k.DoIterativeStoreContent([]byte(toks[1]))
+
+	case toks[0] == "iterativeFindContent":
+		// find a value stored with iterativeStoreContent, checking its hash
+		if len(toks) != 2 {
+			response = "usage: iterativeFindContent [key]"
+			return
+		}
+		key, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		response, _, _ = k.DoIterativeFindContent(key)
+
+	case toks[0] == "iterativePutRecord":
+		// sign a value with the key in keyfile, created if missing, and
+		// store it under the key derived from its public key
+		if len(toks) != 3 {
+			response = "usage: iterativePutRecord [keyfile] [value]"
+			return
+		}
+		priv, err := kademlia.LoadOrCreateRecordKey(toks[1])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response, _, _ = k.DoIterativePutRecord(priv, []byte(toks[2]))
+
+	case toks[0] == "put_file":
+		// store a file of any size, printing the key to get it back with
+		if len(toks) != 2 {
+			response = "usage: put_file [path]"
+			return
+		}
+		data, err := os.ReadFile(toks[1])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		key, err := k.PutBlob(data)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: " + key.AsString()
+
+	case toks[0] == "get_file":
+		// fetch a file stored with put_file and write it to path
+		if len(toks) != 3 {
+			response = "usage: get_file [key] [path]"
+			return
+		}
+		key, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		data, err := k.GetBlob(key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		if err := os.WriteFile(toks[2], data, 0644); err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: wrote " + strconv.Itoa(len(data)) + " bytes to " + toks[2]
+
+	case toks[0] == "trace":
+		// perform an iterative lookup and print how it went
+		if len(toks) != 3 || (toks[1] != "iterativeFindNode" && toks[1] != "iterativeFindValue") {
+			response = "usage: trace [iterativeFindNode | iterativeFindValue] [key]"
+			return
+		}
+		key, err := kademlia.IDFromString(toks[2])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[2] + ")"
+			return
+		}
+		response = k.TraceLookup(key, toks[1] == "iterativeFindValue").String()
+
 	case toks[0] == "vanish":
 		if len(toks) != 5 && len(toks) != 6 {
 			response = "usage: vanish [VDO ID] [data] [numberKeys] [threshold] [timeout(optional)]"
@@ -312,11 +525,26 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			}
 			timeout = int64(tt)
 		}
-		response = k.DoVanish(vdoID, dataBytes, byte(numberKeys), byte(threshold), timeout)
+		report, err := k.Vanish(vdoID, dataBytes, byte(numberKeys), byte(threshold), time.Duration(timeout)*time.Hour)
+		if err != nil && report.Attempted() == 0 {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = report.String()
 
 	case toks[0] == "unvanish":
+		if len(toks) == 2 {
+			// a VDO this node holds
+			vdoID, err := kademlia.IDFromString(toks[1])
+			if err != nil {
+				response = "ERR: Could not parse VDO ID"
+				return
+			}
+			response = k.DoUnvanishLocal(vdoID)
+			return
+		}
 		if len(toks) != 3 {
-			response = "usage: unvanish [Node ID] [VDO ID]"
+			response = "usage: unvanish [Node ID(optional)] [VDO ID]"
 			return
 		}
 		nodeID, err := kademlia.IDFromString(toks[1])
@@ -336,6 +564,74 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		response = k.DoUnvanish(contact, vdoID)
 
+	case toks[0] == "vdo_list":
+		// list the VDOs whose shares are pushed again at every epoch
+		response = k.DoVDOList()
+
+	case toks[0] == "vdo_cancel":
+		if len(toks) != 2 {
+			response = "usage: vdo_cancel [VDO ID]"
+			return
+		}
+		vdoID, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Could not parse VDO ID"
+			return
+		}
+		response = k.DoVDOCancel(vdoID)
+
+	case toks[0] == "vdo_extend":
+		if len(toks) != 3 {
+			response = "usage: vdo_extend [VDO ID] [hours]"
+			return
+		}
+		vdoID, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Could not parse VDO ID"
+			return
+		}
+		hours, err := strconv.Atoi(toks[2])
+		if err != nil || hours <= 0 {
+			response = "ERR: Could not parse hours: " + toks[2]
+			return
+		}
+		response = k.DoVDOExtend(vdoID, time.Duration(hours)*time.Hour)
+
+	case toks[0] == "vanish_export":
+		// write a VDO vanished on this node to a file, as text unless binary
+		if len(toks) != 3 && !(len(toks) == 4 && toks[3] == "binary") {
+			response = "usage: vanish_export [VDO ID] [path] [binary(optional)]"
+			return
+		}
+		vdoID, err := kademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Could not parse VDO ID"
+			return
+		}
+		res, encoded := k.DoVanishExport(vdoID, len(toks) == 3)
+		if encoded == nil {
+			response = res
+			return
+		}
+		if err := os.WriteFile(toks[2], encoded, 0600); err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: wrote VDO to " + toks[2]
+
+	case toks[0] == "unvanish_import":
+		// unvanish a VDO read from a file written by vanish_export
+		if len(toks) != 2 {
+			response = "usage: unvanish_import [path]"
+			return
+		}
+		encoded, err := os.ReadFile(toks[1])
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = k.DoUnvanishImport(encoded)
+
 	default:
 		response = "ERR: Unknown command"
 	}
@@ -80,7 +80,8 @@ func Split(n, k byte, secret []byte) (map[byte][]byte, error) {
 // Combine the given shares into the original secret.
 //
 // N.B.: There is no way to know whether the returned value is, in fact, the
-// original secret.
+// original secret. Use SplitVerifiable and CombineVerifiable for shares which
+// can be checked.
 func Combine(shares map[byte][]byte) []byte {
 	var secret []byte
 	for _, v := range shares {
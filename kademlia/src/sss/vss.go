@@ -0,0 +1,194 @@
+package sss
+
+// Feldman's verifiable secret sharing. The secret is shared with a random
+// polynomial over Z_q, q being the order of the subgroup generated by g in
+// Z_p*, and the dealer publishes a commitment g^a mod p to each coefficient a.
+// Anyone can then check a share (x, y) against the commitments, since
+// g^y = C0 * C1^x * ... * Ck-1^(x^(k-1)) mod p holds for valid shares only,
+// and combining only uses shares that pass this check.
+//
+// The group is the 2048-bit MODP group of RFC 3526, in which 2 generates the
+// subgroup of prime order q = (p-1)/2. The commitment g^secret is public, so
+// the secret must be hard to guess on its own, as a random key is.
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const modp2048 = "FFFFFFFF FFFFFFFF C90FDAA2 2168C234 C4C6628B 80DC1CD1 29024E08 8A67CC74" +
+	"020BBEA6 3B139B22 514A0879 8E3404DD EF9519B3 CD3A431B 302B0A6D F25F1437" +
+	"4FE1356D 6D51C245 E485B576 625E7EC6 F44C42E9 A637ED6B 0BFF5CB6 F406B7ED" +
+	"EE386BFB 5A899FA5 AE9F2411 7C4B1FE6 49286651 ECE45B3D C2007CB8 A163BF05" +
+	"98DA4836 1C55D39A 69163FA8 FD24CF5F 83655D23 DCA3AD96 1C62F356 208552BB" +
+	"9ED52907 7096966D 670C354E 4ABC9804 F1746C08 CA18217C 32905E46 2E36CE3B" +
+	"E39E772C 180E8603 9B2783A2 EC07A28F B5C55DF0 6F4C52C9 DE2BCBF6 95581718" +
+	"3995497C EA956AE5 15D22618 98FA0510 15728E5A 8AACAA68 FFFFFFFF FFFFFFFF"
+
+var (
+	groupP, _ = new(big.Int).SetString(strings.Replace(modp2048, " ", "", -1), 16)
+	groupQ    = new(big.Int).Rsh(groupP, 1)
+	groupG    = big.NewInt(2)
+	// length of the encoded shares and commitments
+	groupLen = (groupP.BitLen() + 7) / 8
+)
+
+var (
+	// ErrThresholdAboveCount is returned when K is greater than N.
+	ErrThresholdAboveCount = errors.New("K must be <= N")
+	// ErrSecretTooLong is returned when the secret does not fit in Z_q.
+	ErrSecretTooLong = errors.New("secret must be at most 255 bytes")
+	// ErrTooFewValidShares is returned when fewer than K shares match the
+	// commitments.
+	ErrTooFewValidShares = errors.New("fewer than K valid shares")
+	// ErrInvalidCommitments is returned when the shares combine to a secret
+	// which does not match the commitments.
+	ErrInvalidCommitments = errors.New("commitments do not match the secret")
+)
+
+func encodeElement(v *big.Int) []byte {
+	return v.FillBytes(make([]byte, groupLen))
+}
+
+// SplitVerifiable splits the given secret into N shares of which K are
+// required to recover the secret, as Split does, and also returns the K
+// commitments the shares can be verified against with VerifyShare.
+func SplitVerifiable(n, k byte, secret []byte) (map[byte][]byte, [][]byte, error) {
+	if n <= 2 {
+		return nil, nil, ErrInvalidCount
+	}
+
+	if k <= 1 {
+		return nil, nil, ErrInvalidThreshold
+	}
+
+	if k > n {
+		return nil, nil, ErrThresholdAboveCount
+	}
+
+	// the leading 1 keeps the leading zeros of the secret
+	s := new(big.Int).SetBytes(append([]byte{1}, secret...))
+	if s.Cmp(groupQ) >= 0 {
+		return nil, nil, ErrSecretTooLong
+	}
+
+	coefficients := []*big.Int{s}
+	for i := byte(1); i < k; i++ {
+		a, err := rand.Int(rand.Reader, groupQ)
+		if err != nil {
+			return nil, nil, err
+		}
+		coefficients = append(coefficients, a)
+	}
+
+	commitments := make([][]byte, k)
+	for i, a := range coefficients {
+		commitments[i] = encodeElement(new(big.Int).Exp(groupG, a, groupP))
+	}
+
+	shares := make(map[byte][]byte, n)
+	for x := byte(1); x <= n; x++ {
+		shares[x] = encodeElement(evalModQ(coefficients, big.NewInt(int64(x))))
+	}
+
+	return shares, commitments, nil
+}
+
+// evaluate the polynomial at the given point, mod q
+func evalModQ(coefficients []*big.Int, x *big.Int) *big.Int {
+	// Horner's scheme
+	result := new(big.Int)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result.Mul(result, x)
+		result.Add(result, coefficients[i])
+		result.Mod(result, groupQ)
+	}
+	return result
+}
+
+func validElement(b []byte, max *big.Int) (*big.Int, bool) {
+	if len(b) != groupLen {
+		return nil, false
+	}
+	v := new(big.Int).SetBytes(b)
+	return v, v.Sign() > 0 && v.Cmp(max) < 0
+}
+
+// VerifyShare returns whether the share with the given ID matches the
+// commitments returned by SplitVerifiable.
+func VerifyShare(x byte, share []byte, commitments [][]byte) bool {
+	if x == 0 || len(commitments) < 2 {
+		return false
+	}
+	y, ok := validElement(share, groupQ)
+	if !ok {
+		return false
+	}
+
+	// C0 * C1^x * ... * Ck-1^(x^(k-1))
+	expected := big.NewInt(1)
+	power := big.NewInt(1)
+	bx := big.NewInt(int64(x))
+	for _, b := range commitments {
+		c, ok := validElement(b, groupP)
+		if !ok {
+			return false
+		}
+		expected.Mul(expected, new(big.Int).Exp(c, power, groupP))
+		expected.Mod(expected, groupP)
+		power.Mul(power, bx)
+	}
+
+	return new(big.Int).Exp(groupG, y, groupP).Cmp(expected) == 0
+}
+
+// CombineVerifiable combines shares returned by SplitVerifiable into the
+// original secret, ignoring the shares which do not match the commitments.
+//
+// Unlike Combine, it fails rather than return a wrong secret.
+func CombineVerifiable(shares map[byte][]byte, commitments [][]byte) ([]byte, error) {
+	var xs []int
+	for x, y := range shares {
+		if VerifyShare(x, y, commitments) {
+			xs = append(xs, int(x))
+		}
+	}
+	k := len(commitments)
+	if len(xs) < k {
+		return nil, ErrTooFewValidShares
+	}
+	sort.Ints(xs)
+	xs = xs[:k]
+
+	// Lagrange interpolation at 0, mod q
+	s := new(big.Int)
+	for i, xi := range xs {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for j, xj := range xs {
+			if i == j {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(xj)))
+			den.Mul(den, big.NewInt(int64(xj-xi)))
+		}
+		den.Mod(den, groupQ)
+		term := new(big.Int).SetBytes(shares[byte(xi)])
+		term.Mul(term, num)
+		term.Mul(term, den.ModInverse(den, groupQ))
+		s.Add(s, term)
+	}
+	s.Mod(s, groupQ)
+
+	c0, _ := validElement(commitments[0], groupP)
+	if new(big.Int).Exp(groupG, s, groupP).Cmp(c0) != 0 {
+		return nil, ErrInvalidCommitments
+	}
+	secret := s.Bytes()
+	if len(secret) == 0 || secret[0] != 1 {
+		return nil, ErrInvalidCommitments
+	}
+	return secret[1:], nil
+}
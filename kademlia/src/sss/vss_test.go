@@ -0,0 +1,92 @@
+package sss
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitVerifiable(t *testing.T) {
+	secret := []byte("\x00\x00leading zeros")
+	shares, commitments, err := SplitVerifiable(5, 3, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := len(commitments), 3; v != want {
+		t.Errorf("Was %v, but expected %v", v, want)
+	}
+
+	for x, y := range shares {
+		if !VerifyShare(x, y, commitments) {
+			t.Errorf("Share %v should be valid", x)
+		}
+	}
+
+	subset := map[byte][]byte{1: shares[1], 3: shares[3], 5: shares[5]}
+	if v, err := CombineVerifiable(subset, commitments); err != nil || !bytes.Equal(v, secret) {
+		t.Errorf("Was %q (%v), but expected %q", v, err, secret)
+	}
+}
+
+func TestVerifyShareTampered(t *testing.T) {
+	shares, commitments, err := SplitVerifiable(5, 3, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, shares[2]...)
+	tampered[len(tampered)-1] ^= 1
+	if VerifyShare(2, tampered, commitments) {
+		t.Error("A tampered share should not verify")
+	}
+
+	if VerifyShare(3, shares[2], commitments) {
+		t.Error("A share should not verify under another ID")
+	}
+
+	_, others, _ := SplitVerifiable(5, 3, []byte("secret"))
+	if VerifyShare(2, shares[2], others) {
+		t.Error("A share should not verify against other commitments")
+	}
+}
+
+func TestCombineVerifiableSkipsBadShares(t *testing.T) {
+	secret := []byte("secret")
+	shares, commitments, err := SplitVerifiable(5, 3, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares[1] = shares[2]
+	if v, err := CombineVerifiable(shares, commitments); err != nil || !bytes.Equal(v, secret) {
+		t.Errorf("Was %q (%v), but expected %q", v, err, secret)
+	}
+
+	delete(shares, 3)
+	delete(shares, 4)
+	if _, err := CombineVerifiable(shares, commitments); err != ErrTooFewValidShares {
+		t.Errorf("Was %v, but expected %v", err, ErrTooFewValidShares)
+	}
+}
+
+func TestSplitVerifiableLongest(t *testing.T) {
+	secret := bytes.Repeat([]byte{0xff}, 255)
+	shares, commitments, err := SplitVerifiable(3, 2, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := CombineVerifiable(shares, commitments); err != nil || !bytes.Equal(v, secret) {
+		t.Errorf("Was %v, but expected the secret back", err)
+	}
+}
+
+func TestSplitVerifiableInvalid(t *testing.T) {
+	if _, _, err := SplitVerifiable(3, 4, []byte("secret")); err != ErrThresholdAboveCount {
+		t.Errorf("Was %v, but expected %v", err, ErrThresholdAboveCount)
+	}
+
+	if _, _, err := SplitVerifiable(5, 3, make([]byte, 256)); err != ErrSecretTooLong {
+		t.Errorf("Was %v, but expected %v", err, ErrSecretTooLong)
+	}
+}